@@ -0,0 +1,56 @@
+package gokiq
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ActiveJobWrapper is the Sidekiq class that runs ActiveJob jobs in Rails.
+const ActiveJobWrapper = "ActiveJob::QueueAdapters::SidekiqAdapter::JobWrapper"
+
+// EnqueueActiveJob pushes a job for a Rails ActiveJob class onto a queue
+// ("default" if empty), wrapped like ActiveJob's Sidekiq adapter does: the
+// Sidekiq class is ActiveJobWrapper, wrapped is jobClass, and the only arg is
+// the serialized job with a new job_id and the args as its arguments. Maps in
+// args are received with string keys. It returns the jid.
+func (c *ClientConfig) EnqueueActiveJob(jobClass, queue string, args ...interface{}) (string, error) {
+	if jobClass == "" {
+		return "", ErrMissingClass
+	}
+	if queue == "" {
+		queue = "default"
+	}
+	if args == nil {
+		args = []interface{}{}
+	}
+	job := map[string]interface{}{
+		"job_class":            jobClass,
+		"job_id":               generateUUID(),
+		"provider_job_id":      nil,
+		"queue_name":           queue,
+		"priority":             nil,
+		"arguments":            args,
+		"executions":           0,
+		"exception_executions": map[string]interface{}{},
+		"locale":               "en",
+		"timezone":             "UTC",
+		"enqueued_at":          time.Now().UTC().Format("2006-01-02T15:04:05.000000000Z"),
+	}
+	payload := map[string]interface{}{
+		"class":   ActiveJobWrapper,
+		"wrapped": jobClass,
+		"args":    []interface{}{job},
+	}
+	return c.enqueuePayload(queue, payload, time.Time{})
+}
+
+// generates a random version 4 UUID, as ActiveJob uses for job ids
+func generateUUID() string {
+	b := make([]byte, 16)
+	io.ReadFull(rand.Reader, b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
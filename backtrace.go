@@ -0,0 +1,75 @@
+package gokiq
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// sets the error_backtrace of a job that asks for one. A panic's stack is
+// where it happened; a returned error has no stack of its own, so it gets the
+// stack of the worker goroutine that handled it.
+func (w *WorkerConfig) setBacktrace(job *Job, err error) {
+	lines := w.backtraceLines(job)
+	if lines <= 0 {
+		job.ErrorBacktrace = nil
+		return
+	}
+	var stack []StackFrame
+	if perr, ok := err.(*PanicError); ok {
+		stack = perr.Stack
+	} else {
+		stack = callerStack(2)
+	}
+	if len(stack) > lines {
+		stack = stack[:lines]
+	}
+	job.ErrorBacktrace = formatStack(stack)
+}
+
+// the number of backtrace lines a job asks for
+func (w *WorkerConfig) backtraceLines(job *Job) int {
+	switch backtrace := job.Backtrace.(type) {
+	case bool:
+		if !backtrace {
+			return 0
+		}
+		if w.BacktraceLines > 0 {
+			return w.BacktraceLines
+		}
+		return defaultBacktraceLines
+	case float64:
+		return int(backtrace)
+	case int:
+		return backtrace
+	}
+	return 0
+}
+
+// the stack of the calling goroutine, without the first skip frames starting
+// with the caller
+func callerStack(skip int) []StackFrame {
+	var stack []StackFrame
+	for i := skip + 1; ; i++ {
+		var frame StackFrame
+		var ok bool
+		frame.PC, frame.File, frame.Line, ok = runtime.Caller(i)
+		if !ok {
+			break
+		}
+		stack = append(stack, frame)
+	}
+	return stack
+}
+
+// formats a stack like a Ruby backtrace, for Sidekiq's Web UI
+func formatStack(stack []StackFrame) []string {
+	lines := make([]string, len(stack))
+	for i, frame := range stack {
+		name := "unknown"
+		if fn := runtime.FuncForPC(frame.PC); fn != nil {
+			name = fn.Name()
+		}
+		lines[i] = fmt.Sprintf("%s:%d:in `%s'", frame.File, frame.Line, name)
+	}
+	return lines
+}
@@ -0,0 +1,64 @@
+package gokiq
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+)
+
+// the longest line EnqueueFromFile reads, to allow for jobs with large args
+const maxBackupLine = 16 << 20
+
+// appends jobs to BackupFile, one JSON payload per line
+func (w *WorkerConfig) backupJobs(jobs []*Job) error {
+	f, err := os.OpenFile(w.BackupFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, job := range jobs {
+		buf.Write(job.JSON())
+		buf.WriteByte('\n')
+	}
+	if _, err = f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// EnqueueFromFile pushes the jobs in a file of JSON payloads, one per line,
+// back onto their queues. It restores the jobs that a worker wrote to its
+// BackupFile when it couldn't requeue them on shutdown. It returns the number
+// of jobs queued before the first error.
+func (c *ClientConfig) EnqueueFromFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	c.initOnce.Do(func() { c.init() })
+
+	count := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxBackupLine)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		job := &Job{}
+		if err := job.FromJSON(line); err != nil {
+			return count, err
+		}
+		if job.Queue == "" {
+			job.Queue = "default"
+		}
+		c.trackQueue(job.Queue)
+		if _, err := c.redisQuery("RPUSH", c.nsKey("queue:"+job.Queue), line); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, scanner.Err()
+}
@@ -0,0 +1,155 @@
+package gokiq
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Batch stages jobs that are pushed together by Commit in one MULTI/EXEC, for
+// example when one event fans out into several jobs, so that no other client
+// sees only some of them queued. A Batch is not safe for concurrent use.
+type Batch struct {
+	client *ClientConfig
+	jobs   []stagedJob
+}
+
+type stagedJob struct {
+	msg map[string]interface{}
+	at  time.Time
+}
+
+// Batch returns an empty batch of jobs for the client.
+func (c *ClientConfig) Batch() *Batch {
+	return &Batch{client: c}
+}
+
+// Enqueue stages a job like ClientConfig.Enqueue, running the client's
+// middleware, and returns its jid. Nothing is pushed until Commit.
+func (b *Batch) Enqueue(class, queue string, args ...interface{}) (string, error) {
+	return b.EnqueueAt(time.Time{}, class, queue, args...)
+}
+
+// EnqueueAt stages a job like ClientConfig.EnqueueAt and returns its jid.
+func (b *Batch) EnqueueAt(t time.Time, class, queue string, args ...interface{}) (string, error) {
+	if args == nil {
+		args = []interface{}{}
+	}
+	msg, err := b.client.newPayload(queue, map[string]interface{}{"class": class, "args": args}, t.After(time.Now()))
+	if err != nil {
+		return "", err
+	}
+	staged := false
+	err = b.client.runMiddleware(msg, func() error {
+		b.jobs = append(b.jobs, stagedJob{msg: msg, at: t})
+		staged = true
+		return nil
+	})
+	if err != nil || !staged {
+		return "", err
+	}
+	return fmt.Sprint(msg["jid"]), nil
+}
+
+// BatchError is returned by Commit when some of the pushes in its transaction
+// failed. Redis doesn't roll back the others, so only the jobs in Errors, by
+// jid, weren't pushed.
+type BatchError struct {
+	Errors map[string]error
+}
+
+func (e BatchError) Error() string {
+	jids := make([]string, 0, len(e.Errors))
+	for jid := range e.Errors {
+		jids = append(jids, jid)
+	}
+	sort.Strings(jids)
+	failed := make([]string, len(jids))
+	for i, jid := range jids {
+		failed[i] = fmt.Sprintf("%s: %s", jid, e.Errors[jid])
+	}
+	return fmt.Sprintf("gokiq: %d jobs in batch failed to push: %s", len(jids), strings.Join(failed, "; "))
+}
+
+// Len returns the number of jobs staged in the batch.
+func (b *Batch) Len() int {
+	return len(b.jobs)
+}
+
+// Commit pushes the staged jobs in one MULTI/EXEC and empties the batch. If a
+// job is a duplicate of a unique job, or the transaction can't be run, none of
+// the jobs are pushed and the batch is left as it was. If only some of the
+// pushes fail, like one to a key of the wrong type, the rest are still pushed
+// and a BatchError is returned, with the failed jobs left in the batch.
+func (b *Batch) Commit() error {
+	if len(b.jobs) == 0 {
+		return nil
+	}
+	c := b.client
+	c.initOnce.Do(func() { c.init() })
+
+	jobs := make([]*Job, 0, len(b.jobs))
+	unlock := func() {
+		for _, job := range jobs {
+			c.unlockUnique(job)
+		}
+	}
+	data := make([][]byte, len(b.jobs))
+	for i, staged := range b.jobs {
+		msg := staged.msg
+		job := &Job{Type: fmt.Sprint(msg["class"]), ID: fmt.Sprint(msg["jid"]), Queue: fmt.Sprint(msg["queue"])}
+		if err := c.lockUnique(job, payloadArgs(msg)); err != nil {
+			unlock()
+			return err
+		}
+		jobs = append(jobs, job)
+		if job.UniqueKey != "" {
+			msg["unique_key"], msg["unique_until"] = job.UniqueKey, job.UniqueUntil
+		}
+		var err error
+		if data[i], err = json.Marshal(msg); err != nil {
+			unlock()
+			return err
+		}
+	}
+
+	conn := c.getConn()
+	defer conn.Close()
+	conn.Send("MULTI")
+	for i, staged := range b.jobs {
+		if staged.at.After(time.Now()) {
+			conn.Send("ZADD", c.nsKey("schedule"), timeFloat(staged.at), data[i])
+		} else {
+			conn.Send("RPUSH", c.nsKey("queue:"+jobs[i].Queue), data[i])
+		}
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		unlock()
+		return err
+	}
+
+	var failed []stagedJob
+	errs := make(map[string]error)
+	for i, job := range jobs {
+		if i < len(replies) {
+			if err, ok := replies[i].(redis.Error); ok {
+				c.unlockUnique(job)
+				failed = append(failed, b.jobs[i])
+				errs[job.ID] = err
+				continue
+			}
+		}
+		c.trackQueue(job.Queue)
+		c.emitEvent(EventEnqueued, job, job.Queue)
+	}
+	b.jobs = failed
+	if len(errs) > 0 {
+		return BatchError{errs}
+	}
+	return nil
+}
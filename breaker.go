@@ -0,0 +1,97 @@
+package gokiq
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+// the circuit breaker of a worker class
+type breaker struct {
+	failures     int       // consecutive failures
+	firstFailure time.Time // of the current run of failures
+	openUntil    time.Time // zero while closed
+	probing      bool      // a job has been let through since the cooldown ended
+}
+
+func (w *WorkerConfig) breakerCooldown() time.Duration {
+	if w.BreakerCooldown <= 0 {
+		return defaultBreakerCooldown
+	}
+	return w.BreakerCooldown
+}
+
+// whether a job of the class can be performed, which is always true unless
+// its breaker is open. Once the cooldown is over, one job is let through to
+// probe whether the class works again.
+func (w *WorkerConfig) breakerAllows(class string) bool {
+	if w.BreakerThreshold <= 0 {
+		return true
+	}
+	w.breakerMtx.Lock()
+	defer w.breakerMtx.Unlock()
+	b := w.breakers[class]
+	if b == nil || b.openUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	log.Printf("event=breaker_half_open job_type=%s pid=%d", class, pid)
+	return true
+}
+
+// counts the result of a job of the class, opening or closing its breaker
+func (w *WorkerConfig) recordBreaker(class string, success bool) {
+	if w.BreakerThreshold <= 0 {
+		return
+	}
+	w.breakerMtx.Lock()
+	defer w.breakerMtx.Unlock()
+	b := w.breakers[class]
+	if success {
+		if b != nil && !b.openUntil.IsZero() {
+			log.Printf("event=breaker_closed job_type=%s pid=%d", class, pid)
+		}
+		delete(w.breakers, class)
+		return
+	}
+
+	now := time.Now()
+	if b == nil {
+		if w.breakers == nil {
+			w.breakers = make(map[string]*breaker)
+		}
+		b = &breaker{}
+		w.breakers[class] = b
+	}
+	if b.probing {
+		b.probing = false
+		b.openUntil = now.Add(w.breakerCooldown())
+		log.Printf("event=breaker_open job_type=%s cooldown=%s probe=true pid=%d", class, w.breakerCooldown(), pid)
+		return
+	}
+	if !b.openUntil.IsZero() {
+		return // a job that started before the breaker opened
+	}
+	if b.failures == 0 || (w.BreakerWindow > 0 && now.Sub(b.firstFailure) > w.BreakerWindow) {
+		b.failures, b.firstFailure = 0, now
+	}
+	b.failures++
+	if b.failures >= w.BreakerThreshold {
+		b.openUntil = now.Add(w.breakerCooldown())
+		log.Printf("event=breaker_open job_type=%s failures=%d cooldown=%s pid=%d", class, b.failures, w.breakerCooldown(), pid)
+	}
+}
+
+// puts a job whose class's breaker is open in the schedule set to be queued
+// again after the cooldown, without counting it as a retry
+func (w *WorkerConfig) deferJob(job *Job) {
+	at := timeFloat(time.Now().Add(w.breakerCooldown()))
+	_, err := w.redisQuery("ZADD", w.nsKey("schedule"), strconv.FormatFloat(at, 'f', -1, 64), job.JSON())
+	if err != nil {
+		w.handleError(err)
+	}
+	log.Printf("event=job_deferred job_id=%s job_type=%s queue=%s success=%t pid=%d", job.ID, job.Type, job.Queue, err == nil, pid)
+}
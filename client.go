@@ -7,6 +7,7 @@ import (
 	"io"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
@@ -18,11 +19,49 @@ type jobMap map[reflect.Type]JobConfig
 
 type ClientConfig struct {
 	RedisPool      *redis.Pool
+	RedisServer    string // host:port or redis:// URL dialed by the default pool, 127.0.0.1:6379 if empty
 	RedisNamespace string
 	Fake           bool
+	EventStream    string // key of a Redis stream that enqueued events are added to, if set; errors adding them are logged
+
+	// BulkParallelism is the number of queues that QueueJobs pushes to at
+	// once, each on its own connection. It defaults to one.
+	BulkParallelism int
+
+	// BulkBatchSize is the number of jobs that EnqueueBulk pushes with each
+	// command. It defaults to 1000.
+	BulkBatchSize int
+
+	// StrictArgs makes the enqueue methods that take args return a
+	// StrictArgsError for args that other Sidekiq apps can't read back as
+	// they were given, like time.Time values, channels, or structs with
+	// unexported fields, instead of pushing them. Registered workers pushed by
+	// QueueJob aren't checked.
+	StrictArgs bool
+
+	// JIDGenerator makes the jids of the jobs the client pushes without one,
+	// for example to embed a shard or tenant. They are 24 random hex
+	// characters like Sidekiq's if it is nil.
+	JIDGenerator func() string
+
+	// PoolSize is the number of connections in the default pool, which is
+	// only made if RedisPool is nil. Callers wait for a free connection when
+	// they are all in use; see PoolStats.
+	PoolSize int
+
+	// SortedQueues are the queues whose jobs pushed with a priority (see
+	// WithPriority) go into the queue's sorted set instead of its list. They
+	// should match the workers' SortedQueues, which are the only ones that
+	// fetch from the sorted sets.
+	SortedQueues []string
 
 	jobMapping  jobMap
+	middleware  []ClientMiddleware
+	uniqueJobs  map[string]uniqueConfig // by class, guarded by mtx
 	knownQueues map[string]struct{}
+	queuesAdded bool  // whether init has added knownQueues to the queues set
+	gets        int64 // connections taken from the pool, accessed atomically
+	waitNanos   int64 // time spent waiting for them, accessed atomically
 	initOnce    sync.Once
 	mtx         sync.Mutex
 }
@@ -34,22 +73,48 @@ func NewClientConfig() *ClientConfig {
 	}
 }
 
-func (c *ClientConfig) Register(worker Worker, queue string, retries int) {
-	t := workerType(worker)
-	c.jobMapping[t] = JobConfig{Queue: queue, MaxRetries: retries, Name: t.Name()}
-	c.trackQueue(queue)
+// QueueWorker can be implemented by workers to choose the queue for their
+// jobs when they are registered without one.
+type QueueWorker interface {
+	Queue() string
+}
+
+func (c *ClientConfig) Register(worker Worker, queue string, retries int) error {
+	if isNilWorker(worker) {
+		return ErrNilWorker
+	}
+	return c.RegisterName(workerType(worker).Name(), worker, queue, retries)
 }
 
-func (c *ClientConfig) RegisterName(name string, worker Worker, queue string, retries int) {
+func (c *ClientConfig) RegisterName(name string, worker Worker, queue string, retries int) error {
+	if isNilWorker(worker) {
+		return ErrNilWorker
+	}
+	if queue == "" {
+		queue = defaultQueue(worker)
+	}
 	c.jobMapping[workerType(worker)] = JobConfig{Queue: queue, MaxRetries: retries, Name: name}
 	c.trackQueue(queue)
+	return nil
 }
 
 func (c *ClientConfig) init() {
 	if c.RedisPool == nil {
+		size := c.PoolSize
+		if size <= 0 {
+			size = defaultClientPoolSize
+		}
 		c.RedisPool = redis.NewPool(func() (redis.Conn, error) {
-			return redis.Dial("tcp", defaultRedisServer)
-		}, 1)
+			return dialServer(c.RedisServer)
+		}, size)
+		c.RedisPool.MaxActive = size
+		c.RedisPool.Wait = true
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.queuesAdded = true
+	if len(c.knownQueues) == 0 {
+		return
 	}
 	queues := make([]interface{}, 1, len(c.knownQueues)+1)
 	queues[0] = c.nsKey("queues")
@@ -60,6 +125,9 @@ func (c *ClientConfig) init() {
 }
 
 func (c *ClientConfig) QueueJob(worker Worker) error {
+	if isNilWorker(worker) {
+		return ErrNilWorker
+	}
 	c.initOnce.Do(func() { c.init() })
 	config, ok := c.jobMapping[workerType(worker)]
 	if !ok {
@@ -69,6 +137,9 @@ func (c *ClientConfig) QueueJob(worker Worker) error {
 }
 
 func (c *ClientConfig) QueueJobConfig(worker Worker, config JobConfig) error {
+	if isNilWorker(worker) {
+		return ErrNilWorker
+	}
 	c.initOnce.Do(func() { c.init() })
 	if baseConfig, ok := c.jobMapping[workerType(worker)]; ok {
 		if config.Name == "" {
@@ -78,48 +149,411 @@ func (c *ClientConfig) QueueJobConfig(worker Worker, config JobConfig) error {
 			config.Queue = baseConfig.Queue
 		}
 	}
+	if config.Queue == "" {
+		config.Queue = defaultQueue(worker)
+	}
 	c.trackQueue(config.Queue)
 	return c.queueJob(worker, config)
 }
 
 func (c *ClientConfig) queueJob(worker Worker, config JobConfig) error {
-	data, err := json.Marshal(worker)
+	job, err := c.newClientJob(worker, config)
 	if err != nil {
 		return err
 	}
-	args := json.RawMessage(data)
-	job := &Job{
-		Type:  config.Name,
-		Args:  &args,
-		Retry: config.MaxRetries,
-		ID:    generateJobID(),
-	}
 	if c.Fake {
 		return worker.Perform()
 	}
+	return c.pushJob(job, config.Queue, config.At)
+}
 
-	if config.At.IsZero() {
-		_, err = c.redisQuery("RPUSH", c.nsKey("queue:"+config.Queue), job.JSON())
+// pushes a job onto a queue, or into the schedule set if at isn't zero
+func (c *ClientConfig) pushJob(job *Job, queue string, at time.Time) error {
+	if !at.IsZero() {
+		job.EnqueuedAt = 0 // set when the scheduler queues it
+	}
+	if len(c.middleware) > 0 {
+		msg, err := jobPayload(job)
+		if err != nil {
+			return err
+		}
+		msg["queue"] = queue
+		return c.runMiddleware(msg, func() error { return c.pushPayload(msg, at) })
+	}
+	job.Queue = queue
+	if err := c.lockUnique(job, *job.Args); err != nil {
+		return err
+	}
+	var err error
+	if at.IsZero() {
+		_, err = c.redisQuery("RPUSH", c.nsKey("queue:"+queue), job.JSON())
 	} else {
-		job.Queue = config.Queue
-		_, err = c.redisQuery("ZADD", c.nsKey("schedule"), timeFloat(config.At), job.JSON())
+		_, err = c.redisQuery("ZADD", c.nsKey("schedule"), timeFloat(at), job.JSON())
+	}
+	if err != nil {
+		c.unlockUnique(job)
+		return err
+	}
+	c.emitEvent(EventEnqueued, job, queue)
+	return nil
+}
+
+// EnqueuePayload pushes a Sidekiq job given as a map of payload fields, for
+// producers that don't have a registered worker. The class field is required;
+// jid, args, retry, created_at and enqueued_at are filled in if missing, and
+// queue is set to the given queue, or "default" if both are empty. It returns
+// the job's jid.
+func (c *ClientConfig) EnqueuePayload(queue string, payload map[string]interface{}) (string, error) {
+	return c.enqueuePayload(queue, payload, time.Time{})
+}
+
+// pushes a payload onto a queue, or into the schedule set if at is in the
+// future, in which case enqueued_at is left for when it is queued, and returns
+// the jid it was pushed with
+func (c *ClientConfig) enqueuePayload(queue string, payload map[string]interface{}, at time.Time) (string, error) {
+	msg, err := c.newPayload(queue, payload, at.After(time.Now()))
+	if err != nil {
+		return "", err
+	}
+	c.initOnce.Do(func() { c.init() })
+	if err := c.runMiddleware(msg, func() error { return c.pushPayload(msg, at) }); err != nil {
+		return "", err
+	}
+	return fmt.Sprint(msg["jid"]), nil
+}
+
+// pushes a complete payload onto its queue, or into the schedule set if at is
+// in the future
+func (c *ClientConfig) pushPayload(msg map[string]interface{}, at time.Time) error {
+	queue := fmt.Sprint(msg["queue"])
+	job := &Job{Type: fmt.Sprint(msg["class"]), ID: fmt.Sprint(msg["jid"]), Queue: queue}
+	if err := c.lockUnique(job, payloadArgs(msg)); err != nil {
+		return err
+	}
+	if job.UniqueKey != "" {
+		msg["unique_key"], msg["unique_until"] = job.UniqueKey, job.UniqueUntil
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		c.unlockUnique(job)
+		return err
+	}
+	c.trackQueue(queue)
+	if at.After(time.Now()) {
+		_, err = c.redisQuery("ZADD", c.nsKey("schedule"), timeFloat(at), data)
+	} else if priority, _ := ArgInt64(msg["priority"]); priority != 0 && c.isSorted(queue) {
+		score, member := sortedEntry(int(priority), enqueuedTime(msg), data)
+		_, err = c.redisQuery("ZADD", c.sortedKey(queue), score, member)
+	} else {
+		_, err = c.redisQuery("RPUSH", c.nsKey("queue:"+queue), data)
+	}
+	if err != nil {
+		c.unlockUnique(job)
+		return err
+	}
+	c.emitEvent(EventEnqueued, job, queue)
+	return nil
+}
+
+// fills in the fields of a payload that are missing
+func (c *ClientConfig) newPayload(queue string, payload map[string]interface{}, scheduled bool) (map[string]interface{}, error) {
+	class, _ := payload["class"].(string)
+	if class == "" {
+		return nil, ErrMissingClass
+	}
+	if c.StrictArgs {
+		if err := checkStrictArgs(class, payload["args"]); err != nil {
+			return nil, err
+		}
+	}
+	now := timeFloat(time.Now())
+	msg := map[string]interface{}{
+		"jid":        newJobID(c.JIDGenerator),
+		"args":       []interface{}{},
+		"retry":      true,
+		"created_at": now,
+	}
+	for k, v := range payload {
+		msg[k] = v
+	}
+	if !scheduled {
+		msg["enqueued_at"] = now
+	}
+	if queue == "" {
+		queue, _ = msg["queue"].(string)
+	}
+	if queue == "" {
+		queue = "default"
+	}
+	msg["queue"] = queue
+	return msg, nil
+}
+
+// Enqueue pushes a job for the named worker class, which can be a Go worker
+// or a Sidekiq worker in another app, onto a queue ("default" if empty). The
+// args are marshaled to a JSON array, and the payload gets a jid, retry,
+// created_at and enqueued_at like one pushed by Sidekiq. It returns the jid,
+// a random 24 character hex string like Sidekiq's.
+func (c *ClientConfig) Enqueue(class, queue string, args ...interface{}) (string, error) {
+	return c.EnqueueAt(time.Time{}, class, queue, args...)
+}
+
+// EnqueueIn is like Enqueue, but the job is put in the schedule set to be
+// queued by a worker's scheduler after d, like Sidekiq's perform_in.
+func (c *ClientConfig) EnqueueIn(d time.Duration, class, queue string, args ...interface{}) (string, error) {
+	return c.EnqueueAt(time.Now().Add(d), class, queue, args...)
+}
+
+// EnqueueAt is like Enqueue, but the job is put in the schedule set to be
+// queued by a worker's scheduler at t, like Sidekiq's perform_at. Jobs for a
+// time that has passed are queued right away.
+func (c *ClientConfig) EnqueueAt(t time.Time, class, queue string, args ...interface{}) (string, error) {
+	if args == nil {
+		args = []interface{}{}
 	}
-	return err
+	return c.enqueuePayload(queue, map[string]interface{}{"class": class, "args": args}, t)
 }
 
+// Push pushes a job for the named worker class with the given args, like
+// Enqueue, with its queue, retries, jid, tags, time, expiry and priority set
+// by options. It returns the job's jid.
+func (c *ClientConfig) Push(class string, args []interface{}, options ...EnqueueOption) (string, error) {
+	var o enqueueOptions
+	for _, option := range options {
+		option(&o)
+	}
+	payload := map[string]interface{}{"class": class}
+	if args != nil {
+		payload["args"] = args
+	}
+	if o.retry != nil {
+		payload["retry"] = o.retry
+	}
+	if o.jid != "" {
+		payload["jid"] = o.jid
+	}
+	if len(o.tags) > 0 {
+		payload["tags"] = o.tags
+	}
+	if o.expiresIn > 0 {
+		payload["expires_at"] = expiresAt(o.at, o.expiresIn)
+	}
+	if o.priority != 0 {
+		payload["priority"] = o.priority
+	}
+	return c.enqueuePayload(o.queue, payload, o.at)
+}
+
+// EnqueueBulk pushes a job for the named worker class onto a queue for each
+// set of args, like Sidekiq's push_bulk. The jobs are pushed BulkBatchSize at
+// a time, with one RPUSH per batch. It returns the jids of the jobs that were
+// pushed, which are all of them unless there is an error.
+func (c *ClientConfig) EnqueueBulk(class, queue string, args [][]interface{}) ([]string, error) {
+	c.initOnce.Do(func() { c.init() })
+	batchSize := c.BulkBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultBulkBatchSize
+	}
+
+	jids := make([]string, 0, len(args))
+	for start := 0; start < len(args); start += batchSize {
+		end := start + batchSize
+		if end > len(args) {
+			end = len(args)
+		}
+		batches := make(map[string][]interface{})
+		batchJIDs := make(map[string][]string)
+		var queues []string
+		for _, jobArgs := range args[start:end] {
+			if jobArgs == nil {
+				jobArgs = []interface{}{}
+			}
+			msg, err := c.newPayload(queue, map[string]interface{}{"class": class, "args": jobArgs}, false)
+			if err != nil {
+				return jids, err
+			}
+			err = c.runMiddleware(msg, func() error {
+				data, err := json.Marshal(msg)
+				if err != nil {
+					return err
+				}
+				jobQueue := fmt.Sprint(msg["queue"])
+				if _, ok := batches[jobQueue]; !ok {
+					queues = append(queues, jobQueue)
+				}
+				batches[jobQueue] = append(batches[jobQueue], data)
+				batchJIDs[jobQueue] = append(batchJIDs[jobQueue], fmt.Sprint(msg["jid"]))
+				return nil
+			})
+			if err != nil {
+				return jids, err
+			}
+		}
+
+		// middleware can move jobs to other queues, so there is a batch for each
+		for _, jobQueue := range queues {
+			c.trackQueue(jobQueue)
+			batch := append([]interface{}{c.nsKey("queue:" + jobQueue)}, batches[jobQueue]...)
+			if _, err := c.redisQuery("RPUSH", batch...); err != nil {
+				return jids, err
+			}
+			for _, jid := range batchJIDs[jobQueue] {
+				jids = append(jids, jid)
+				c.emitEvent(EventEnqueued, &Job{Type: class, ID: jid}, jobQueue)
+			}
+		}
+	}
+	return jids, nil
+}
+
+// QueueJobs queues jobs for registered workers in bulk. The jobs are grouped by
+// queue, and each group is pipelined on its own connection, with up to
+// BulkParallelism groups pushed at once. Jobs keep their order within a queue.
+// The returned slice holds the error for each worker, nil if it was queued.
+func (c *ClientConfig) QueueJobs(workers []Worker) []error {
+	c.initOnce.Do(func() { c.init() })
+	errs := make([]error, len(workers))
+	jobs := make([]*Job, len(workers))
+	payloads := make([][]byte, len(workers))
+	groups := make(map[string][]int)
+	var queues []string
+	for i, worker := range workers {
+		if isNilWorker(worker) {
+			errs[i] = ErrNilWorker
+			continue
+		}
+		config, ok := c.jobMapping[workerType(worker)]
+		if !ok {
+			errs[i] = fmt.Errorf("gokiq: Unregistered worker type %T", worker)
+			continue
+		}
+		if c.Fake {
+			errs[i] = worker.Perform()
+			continue
+		}
+		if jobs[i], errs[i] = c.newClientJob(worker, config); errs[i] != nil {
+			continue
+		}
+		queue := config.Queue
+		if len(c.middleware) == 0 {
+			payloads[i] = jobs[i].JSON()
+		} else if queue, errs[i] = c.stagePayload(jobs[i], queue, &payloads[i]); errs[i] != nil || payloads[i] == nil {
+			continue
+		}
+		if _, ok := groups[queue]; !ok {
+			queues = append(queues, queue)
+		}
+		groups[queue] = append(groups[queue], i)
+	}
+
+	parallelism := c.BulkParallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for _, queue := range queues {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(queue string, indices []int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			c.pushJobs(queue, indices, jobs, payloads, errs)
+		}(queue, groups[queue])
+	}
+	wg.Wait()
+	return errs
+}
+
+// pipelines the jobs at indices onto a queue and sets their errors
+func (c *ClientConfig) pushJobs(queue string, indices []int, jobs []*Job, payloads [][]byte, errs []error) {
+	conn := c.getConn()
+	defer conn.Close()
+
+	key := c.nsKey("queue:" + queue)
+	for _, i := range indices {
+		conn.Send("RPUSH", key, payloads[i])
+	}
+	if err := conn.Flush(); err != nil {
+		for _, i := range indices {
+			errs[i] = err
+		}
+		return
+	}
+	for _, i := range indices {
+		if _, errs[i] = conn.Receive(); errs[i] == nil {
+			c.emitEvent(EventEnqueued, jobs[i], queue)
+		}
+	}
+}
+
+func (c *ClientConfig) newClientJob(worker Worker, config JobConfig) (*Job, error) {
+	data, err := json.Marshal(worker)
+	if err != nil {
+		return nil, err
+	}
+	args := json.RawMessage(data)
+	now := timeFloat(time.Now())
+	return &Job{
+		Type:       config.Name,
+		Args:       &args,
+		Retry:      config.MaxRetries,
+		ID:         newJobID(c.JIDGenerator),
+		Tags:       config.Tags,
+		CreatedAt:  now,
+		EnqueuedAt: now,
+		ExpiresAt:  expiresAt(config.At, config.ExpiresIn),
+	}, nil
+}
+
+// adds a queue to the queues set the first time it is used by this client, so
+// that queueing a job doesn't cost an extra command. Queues that are used
+// before the client connects are added together when it does.
 func (c *ClientConfig) trackQueue(queue string) {
 	c.mtx.Lock()
 	if _, ok := c.knownQueues[queue]; !ok {
 		c.knownQueues[queue] = struct{}{}
-		if c.RedisPool != nil {
+		if c.queuesAdded {
 			c.redisQuery("SADD", c.nsKey("queues"), queue)
 		}
 	}
 	c.mtx.Unlock()
 }
 
-func (c *ClientConfig) redisQuery(command string, args ...interface{}) (interface{}, error) {
+// PoolStats describes the use of a client's connection pool.
+type PoolStats struct {
+	Active int           // connections in the pool, idle or in use
+	Idle   int           // idle connections
+	Gets   int64         // connections taken from the pool so far
+	Wait   time.Duration // total time spent getting them
+}
+
+// PoolStats returns the usage of the client's pool, so that producers can
+// tell if the pool is too small for their load.
+func (c *ClientConfig) PoolStats() PoolStats {
+	stats := PoolStats{
+		Gets: atomic.LoadInt64(&c.gets),
+		Wait: time.Duration(atomic.LoadInt64(&c.waitNanos)),
+	}
+	if c.RedisPool != nil {
+		stats.Active = c.RedisPool.ActiveCount()
+		stats.Idle = c.RedisPool.IdleCount()
+	}
+	return stats
+}
+
+func (c *ClientConfig) getConn() redis.Conn {
+	start := time.Now()
 	conn := c.RedisPool.Get()
+	atomic.AddInt64(&c.waitNanos, int64(time.Since(start)))
+	atomic.AddInt64(&c.gets, 1)
+	return conn
+}
+
+func (c *ClientConfig) redisQuery(command string, args ...interface{}) (interface{}, error) {
+	conn := c.getConn()
 	defer conn.Close()
 	return conn.Do(command, args...)
 }
@@ -131,8 +565,34 @@ func (c *ClientConfig) nsKey(key string) string {
 	return key
 }
 
+func defaultQueue(worker Worker) string {
+	if w, ok := worker.(QueueWorker); ok {
+		return w.Queue()
+	}
+	return "default"
+}
+
+// the float Unix time a job expires at, d after at or now, or zero if d is
+func expiresAt(at time.Time, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	if at.IsZero() {
+		at = time.Now()
+	}
+	return timeFloat(at.Add(d))
+}
+
+// makes a jid with generate, or a random one if it is nil
+func newJobID(generate func() string) string {
+	if generate != nil {
+		return generate()
+	}
+	return generateJobID()
+}
+
 func generateJobID() string {
-	b := make([]byte, 8)
+	b := make([]byte, 12)
 	io.ReadFull(rand.Reader, b)
 	return fmt.Sprintf("%x", b)
 }
@@ -141,5 +601,14 @@ type JobConfig struct {
 	Name       string
 	Queue      string
 	MaxRetries int
-	At         time.Time
+	Tags       []string
+
+	// ExpiresIn drops the job instead of running it if a worker fetches it
+	// later than this after it is queued, or after At if it is set.
+	ExpiresIn time.Duration
+
+	// At schedules the job to be queued at a later time. The time is stored
+	// with sub-second precision, but the job is queued by the first scheduler
+	// poll after it, so it may wait for up to the worker's PollInterval.
+	At time.Time
 }
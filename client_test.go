@@ -0,0 +1,832 @@
+package gokiq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	. "launchpad.net/gocheck"
+)
+
+type ClientSuite struct{}
+
+var _ = Suite(&ClientSuite{})
+
+type EmailWorker struct {
+	Address string
+}
+
+func (w *EmailWorker) Perform() error { return nil }
+func (w *EmailWorker) Queue() string  { return "emails" }
+
+func newTestClient(c *C) *ClientConfig {
+	client := NewClientConfig()
+	client.initOnce.Do(client.init)
+	_, err := client.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+	return client
+}
+
+func (s *ClientSuite) TestWorkerQueue(c *C) {
+	client := newTestClient(c)
+	client.Register(&EmailWorker{}, "", 5)
+	MaybeFail(c, client.QueueJob(&EmailWorker{"user@example.com"}))
+	MaybeFail(c, client.QueueJobConfig(&EmailWorker{"user@example.com"}, JobConfig{}))
+	MaybeFail(c, client.QueueJobConfig(&EmailWorker{"user@example.com"}, JobConfig{At: time.Now().Add(time.Hour)}))
+
+	queued, err := redis.Int(client.redisQuery("LLEN", "queue:emails"))
+	MaybeFail(c, err)
+	c.Assert(queued, Equals, 2)
+	data, err := redis.Bytes(client.redisQuery("LINDEX", "queue:emails", 0))
+	MaybeFail(c, err)
+	job := &Job{}
+	MaybeFail(c, job.FromJSON(data))
+	c.Assert(job.CreatedAt, Not(Equals), float64(0))
+	c.Assert(job.EnqueuedAt, Equals, job.CreatedAt)
+	scheduled, err := redis.ByteSlices(client.redisQuery("ZRANGE", "schedule", 0, -1))
+	MaybeFail(c, err)
+	job = &Job{}
+	MaybeFail(c, job.FromJSON(scheduled[0]))
+	c.Assert(job.EnqueuedAt, Equals, float64(0))
+	isMember, err := redis.Bool(client.redisQuery("SISMEMBER", "queues", "emails"))
+	MaybeFail(c, err)
+	c.Assert(isMember, Equals, true)
+}
+
+type BinaryWorker struct {
+	Data  []byte
+	Extra interface{}
+}
+
+var binaryChan = make(chan *BinaryWorker, 1)
+
+func (w *BinaryWorker) Perform() error {
+	binaryChan <- w
+	return nil
+}
+
+func (s *ClientSuite) TestBinaryArgs(c *C) {
+	client := newTestClient(c)
+	client.Register(&BinaryWorker{}, "", 5)
+	data := []byte{0, 1, 0xfe, 0xff, '"', '\n'}
+	MaybeFail(c, client.QueueJob(&BinaryWorker{data, data}))
+
+	w := NewWorkerConfig()
+	MaybeFail(c, w.Register(&BinaryWorker{}))
+	payload, err := redis.Bytes(client.redisQuery("LPOP", "queue:default"))
+	MaybeFail(c, err)
+	job := &Job{}
+	MaybeFail(c, job.FromJSON(payload))
+	w.process(job, "test")
+
+	worker := <-binaryChan
+	c.Assert(worker.Data, DeepEquals, data)
+	extra, err := ArgBytes(worker.Extra)
+	MaybeFail(c, err)
+	c.Assert(extra, DeepEquals, data)
+}
+
+func (s *ClientSuite) TestEventStream(c *C) {
+	client := newTestClient(c)
+	client.EventStream = "events"
+	client.Register(&EmailWorker{}, "", 5)
+	MaybeFail(c, client.QueueJob(&EmailWorker{"user@example.com"}))
+
+	entries, err := redis.Values(client.redisQuery("XRANGE", "events", "-", "+"))
+	MaybeFail(c, err)
+	c.Assert(entries, HasLen, 1)
+	fields, err := redis.StringMap(entries[0].([]interface{})[1], nil)
+	MaybeFail(c, err)
+	c.Assert(fields["event"], Equals, EventEnqueued)
+	c.Assert(fields["class"], Equals, "EmailWorker")
+	c.Assert(fields["queue"], Equals, "emails")
+}
+
+func (s *ClientSuite) TestEventStreamError(c *C) {
+	client := newTestClient(c)
+	client.EventStream = "events"
+	_, err := client.redisQuery("SET", "events", "not a stream")
+	MaybeFail(c, err)
+
+	var jid string
+	log := captureLog(func() {
+		jid, err = client.Enqueue("EmailWorker", "emails", "user@example.com")
+	})
+	c.Assert(err, IsNil)
+	c.Assert(jid, Not(Equals), "")
+	c.Assert(log, Matches, "(?s).*event=event_stream_error.*")
+
+	count, err := redis.Int(client.redisQuery("LLEN", "queue:emails"))
+	MaybeFail(c, err)
+	c.Assert(count, Equals, 1)
+}
+
+func (s *ClientSuite) TestEnqueuePayload(c *C) {
+	client := newTestClient(c)
+	payload := map[string]interface{}{"class": "HardWorker", "args": []interface{}{"bob", 5}}
+	jid, err := client.EnqueuePayload("critical", payload)
+	MaybeFail(c, err)
+	_, err = client.EnqueuePayload("critical", map[string]interface{}{"args": []interface{}{}})
+	c.Assert(err, Equals, ErrMissingClass)
+
+	data, err := redis.Bytes(client.redisQuery("LPOP", "queue:critical"))
+	MaybeFail(c, err)
+	var msg map[string]interface{}
+	MaybeFail(c, json.Unmarshal(data, &msg))
+	c.Assert(msg["class"], Equals, "HardWorker")
+	c.Assert(msg["args"], DeepEquals, []interface{}{"bob", float64(5)})
+	c.Assert(msg["queue"], Equals, "critical")
+	c.Assert(msg["retry"], Equals, true)
+	c.Assert(msg["jid"], Equals, jid)
+	c.Assert(msg["created_at"], FitsTypeOf, float64(0))
+	c.Assert(msg["enqueued_at"], FitsTypeOf, float64(0))
+	c.Assert(payload, HasLen, 2)
+
+	isMember, err := redis.Bool(client.redisQuery("SISMEMBER", "queues", "critical"))
+	MaybeFail(c, err)
+	c.Assert(isMember, Equals, true)
+}
+
+func (s *ClientSuite) TestEnqueue(c *C) {
+	client := newTestClient(c)
+	jid, err := client.Enqueue("HardWorker", "", "bob", 5)
+	MaybeFail(c, err)
+	c.Assert(jid, Matches, "[0-9a-f]{24}")
+	_, err = client.Enqueue("NoArgsWorker", "low")
+	MaybeFail(c, err)
+	_, err = client.Enqueue("", "low")
+	c.Assert(err, Equals, ErrMissingClass)
+
+	data, err := redis.Bytes(client.redisQuery("LPOP", "queue:default"))
+	MaybeFail(c, err)
+	var msg map[string]interface{}
+	MaybeFail(c, json.Unmarshal(data, &msg))
+	c.Assert(msg["class"], Equals, "HardWorker")
+	c.Assert(msg["args"], DeepEquals, []interface{}{"bob", float64(5)})
+	c.Assert(msg["queue"], Equals, "default")
+	c.Assert(msg["retry"], Equals, true)
+	c.Assert(msg["jid"], Equals, jid)
+	c.Assert(msg["enqueued_at"], FitsTypeOf, float64(0))
+
+	data, err = redis.Bytes(client.redisQuery("LPOP", "queue:low"))
+	MaybeFail(c, err)
+	MaybeFail(c, json.Unmarshal(data, &msg))
+	c.Assert(msg["args"], DeepEquals, []interface{}{})
+
+	queues, err := redis.Strings(client.redisQuery("SMEMBERS", "queues"))
+	MaybeFail(c, err)
+	sort.Strings(queues)
+	c.Assert(queues, DeepEquals, []string{"default", "low"})
+}
+
+type strictArgsUser struct {
+	Name  string
+	email string
+}
+
+func (s *ClientSuite) TestStrictArgs(c *C) {
+	client := newTestClient(c)
+	client.StrictArgs = true
+
+	_, err := client.Enqueue("HardWorker", "", "bob", 5, 1.5, true, nil, []byte("raw"),
+		[]interface{}{"a", map[string]interface{}{"b": []int{1}}}, struct{ Name string }{"bob"})
+	MaybeFail(c, err)
+
+	for _, test := range []struct {
+		arg  interface{}
+		path string
+	}{
+		{time.Now(), "args[1]"},
+		{make(chan int), "args[1]"},
+		{func() {}, "args[1]"},
+		{map[int]string{1: "a"}, "args[1]"},
+		{[]interface{}{map[string]interface{}{"user": strictArgsUser{Name: "bob"}}}, "args[1][0].user"},
+		{&struct{ At *time.Time }{&time.Time{}}, "args[1].At"},
+	} {
+		_, err := client.Enqueue("HardWorker", "", "ok", test.arg)
+		c.Assert(err, FitsTypeOf, StrictArgsError{})
+		c.Assert(err.(StrictArgsError).Path, Equals, test.path)
+		c.Assert(err.(StrictArgsError).Type, Equals, "HardWorker")
+	}
+	_, err = client.EnqueueBulk("HardWorker", "", [][]interface{}{{"ok"}, {time.Now()}})
+	c.Assert(err, FitsTypeOf, StrictArgsError{})
+	_, err = client.EnqueueInWindow(WindowSpec{}, "HardWorker", time.Now())
+	c.Assert(err, FitsTypeOf, StrictArgsError{})
+
+	queued, err := redis.Int(client.redisQuery("LLEN", "queue:default"))
+	MaybeFail(c, err)
+	c.Assert(queued, Equals, 1) // the batch with the unsafe arg isn't pushed
+}
+
+func (s *ClientSuite) TestJIDGenerator(c *C) {
+	client := newTestClient(c)
+	client.Register(&EmailWorker{}, "", 5)
+	n := 0
+	client.JIDGenerator = func() string {
+		n++
+		return fmt.Sprintf("eu1-%d", n)
+	}
+
+	jid, err := client.Enqueue("HardWorker", "", "bob")
+	MaybeFail(c, err)
+	c.Assert(jid, Equals, "eu1-1")
+	jids, err := client.EnqueueBulk("HardWorker", "", [][]interface{}{{"alice"}})
+	MaybeFail(c, err)
+	c.Assert(jids, DeepEquals, []string{"eu1-2"})
+	MaybeFail(c, client.QueueJob(&EmailWorker{"user@example.com"}))
+
+	data, err := redis.Bytes(client.redisQuery("LPOP", "queue:emails"))
+	MaybeFail(c, err)
+	job := &Job{}
+	MaybeFail(c, job.FromJSON(data))
+	c.Assert(job.ID, Equals, "eu1-3")
+}
+
+func (s *ClientSuite) TestEnqueueActiveJob(c *C) {
+	client := newTestClient(c)
+	jid, err := client.EnqueueActiveJob("WelcomeMailerJob", "mailers", 42, map[string]interface{}{"locale": "fr"})
+	MaybeFail(c, err)
+	_, err = client.EnqueueActiveJob("", "")
+	c.Assert(err, Equals, ErrMissingClass)
+
+	data, err := redis.Bytes(client.redisQuery("LPOP", "queue:mailers"))
+	MaybeFail(c, err)
+	var msg map[string]interface{}
+	MaybeFail(c, json.Unmarshal(data, &msg))
+	c.Assert(msg["class"], Equals, ActiveJobWrapper)
+	c.Assert(msg["wrapped"], Equals, "WelcomeMailerJob")
+	c.Assert(msg["queue"], Equals, "mailers")
+	c.Assert(msg["jid"], Equals, jid)
+	c.Assert(msg["args"], HasLen, 1)
+	job := msg["args"].([]interface{})[0].(map[string]interface{})
+	c.Assert(job["job_class"], Equals, "WelcomeMailerJob")
+	c.Assert(job["job_id"], Matches, "[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}")
+	c.Assert(job["queue_name"], Equals, "mailers")
+	c.Assert(job["arguments"], DeepEquals, []interface{}{float64(42), map[string]interface{}{"locale": "fr"}})
+	c.Assert(job["executions"], Equals, float64(0))
+	c.Assert(job["enqueued_at"], FitsTypeOf, "")
+}
+
+func (s *ClientSuite) TestEnqueueAt(c *C) {
+	client := newTestClient(c)
+	at := time.Now().Add(time.Hour)
+	jid, err := client.EnqueueAt(at, "HardWorker", "critical", "bob")
+	MaybeFail(c, err)
+	_, err = client.EnqueueIn(time.Minute, "HardWorker", "critical", "alice")
+	MaybeFail(c, err)
+	_, err = client.EnqueueAt(time.Now().Add(-time.Minute), "HardWorker", "critical", "late")
+	MaybeFail(c, err)
+
+	entries, err := redis.Values(client.redisQuery("ZRANGE", "schedule", 0, -1, "WITHSCORES"))
+	MaybeFail(c, err)
+	c.Assert(entries, HasLen, 4)
+	var msg map[string]interface{}
+	MaybeFail(c, json.Unmarshal(entries[2].([]byte), &msg))
+	c.Assert(msg["args"], DeepEquals, []interface{}{"bob"})
+	c.Assert(msg["queue"], Equals, "critical")
+	c.Assert(msg["jid"], Equals, jid)
+	c.Assert(msg["enqueued_at"], IsNil)
+	score, err := redis.Float64(entries[3], nil)
+	MaybeFail(c, err)
+	c.Assert(score, Equals, timeFloat(at))
+
+	// the past job skips the schedule set
+	queued, err := redis.Int(client.redisQuery("LLEN", "queue:critical"))
+	MaybeFail(c, err)
+	c.Assert(queued, Equals, 1)
+
+	// and the scheduler queues the others when they are due
+	w := NewWorkerConfig()
+	_, err = w.redisQuery("ZADD", "schedule", "XX", 0, entries[2])
+	MaybeFail(c, err)
+	promoted, err := w.PromoteDue()
+	MaybeFail(c, err)
+	c.Assert(promoted, Equals, 1)
+}
+
+func (s *ClientSuite) TestPush(c *C) {
+	client := newTestClient(c)
+	jid, err := client.Push("HardWorker", []interface{}{"bob"}, WithQueue("critical"), WithRetry(5), WithJID("abc"), WithTags("vip"))
+	MaybeFail(c, err)
+	c.Assert(jid, Equals, "abc")
+	at := time.Now().Add(time.Hour)
+	_, err = client.Push("HardWorker", nil, WithAt(at), WithExpiresIn(10*time.Minute))
+	MaybeFail(c, err)
+
+	data, err := redis.Bytes(client.redisQuery("LPOP", "queue:critical"))
+	MaybeFail(c, err)
+	var msg map[string]interface{}
+	MaybeFail(c, json.Unmarshal(data, &msg))
+	c.Assert(msg["args"], DeepEquals, []interface{}{"bob"})
+	c.Assert(msg["retry"], Equals, float64(5))
+	c.Assert(msg["jid"], Equals, "abc")
+	c.Assert(msg["tags"], DeepEquals, []interface{}{"vip"})
+
+	scheduled, err := redis.ByteSlices(client.redisQuery("ZRANGE", "schedule", 0, -1))
+	MaybeFail(c, err)
+	c.Assert(scheduled, HasLen, 1)
+	msg = nil
+	MaybeFail(c, json.Unmarshal(scheduled[0], &msg))
+	c.Assert(msg["queue"], Equals, "default")
+	c.Assert(msg["retry"], Equals, true)
+	c.Assert(msg["expires_at"], Equals, timeFloat(at.Add(10*time.Minute)))
+}
+
+func (s *ClientSuite) TestSortedQueues(c *C) {
+	client := newTestClient(c)
+	client.SortedQueues = []string{"work"}
+	push := func(name string, options ...EnqueueOption) {
+		_, err := client.Push("HardWorker", []interface{}{name}, append(options, WithQueue("work"))...)
+		MaybeFail(c, err)
+	}
+	_, err := client.Push("HardWorker", []interface{}{"unsorted"}, WithQueue("other"), WithPriority(5))
+	MaybeFail(c, err)
+	queued, err := redis.Int(client.redisQuery("LLEN", "queue:other"))
+	MaybeFail(c, err)
+	c.Assert(queued, Equals, 1) // the priority is ignored for queues that aren't sorted
+	_, err = client.redisQuery("DEL", "queue:other")
+	MaybeFail(c, err)
+	push("none")
+	push("low", WithPriority(1))
+	push("high", WithPriority(5))
+	push("high2", WithPriority(5))
+	push("urgent", WithPriority(9), WithAt(time.Now().Add(time.Hour)))
+
+	w := NewWorkerConfig()
+	w.Queues = QueueConfig{"work": 1, "other": 1}
+	w.SortedQueues = []string{"work"}
+	scheduled, err := redis.ByteSlices(client.redisQuery("ZRANGE", "schedule", 0, -1))
+	MaybeFail(c, err)
+	_, err = w.redisQuery("ZADD", "schedule", "XX", 0, scheduled[0])
+	MaybeFail(c, err)
+	_, err = w.PromoteDue()
+	MaybeFail(c, err)
+
+	var order []string
+	for i := 0; i < 5; i++ {
+		job, err := StrictFetcher(w).Fetch(context.Background())
+		MaybeFail(c, err)
+		c.Assert(job.Queue, Equals, "work")
+		var args []string
+		MaybeFail(c, json.Unmarshal(*job.Args, &args))
+		order = append(order, args[0])
+	}
+	c.Assert(order, DeepEquals, []string{"urgent", "high", "high2", "low", "none"})
+
+	// a job put back on shutdown keeps its priority and place
+	push("first", WithPriority(5))
+	push("second", WithPriority(5))
+	fetch := func() string {
+		job, err := StrictFetcher(w).Fetch(context.Background())
+		MaybeFail(c, err)
+		var args []string
+		MaybeFail(c, json.Unmarshal(*job.Args, &args))
+		w.work = map[string]*Job{"test": job}
+		return args[0]
+	}
+	c.Assert(fetch(), Equals, "first")
+	w.requeueJobs()
+	queued, err = redis.Int(client.redisQuery("LLEN", "queue:work"))
+	MaybeFail(c, err)
+	c.Assert(queued, Equals, 0)
+	c.Assert(fetch(), Equals, "first")
+	c.Assert(w.pushBack(w.work["test"]), IsNil)
+	c.Assert(fetch(), Equals, "first")
+	c.Assert(fetch(), Equals, "second")
+}
+
+func (s *ClientSuite) TestEnqueueBulk(c *C) {
+	client := newTestClient(c)
+	client.BulkBatchSize = 2
+	args := [][]interface{}{{1}, {2}, {3}, {4}, nil}
+	jids, err := client.EnqueueBulk("HardWorker", "bulk", args)
+	MaybeFail(c, err)
+	c.Assert(jids, HasLen, 5)
+
+	queued, err := redis.ByteSlices(client.redisQuery("LRANGE", "queue:bulk", 0, -1))
+	MaybeFail(c, err)
+	c.Assert(queued, HasLen, 5)
+	for i, data := range queued {
+		var msg map[string]interface{}
+		MaybeFail(c, json.Unmarshal(data, &msg))
+		c.Assert(msg["jid"], Equals, jids[i])
+		c.Assert(msg["class"], Equals, "HardWorker")
+		if i < 4 {
+			c.Assert(msg["args"], DeepEquals, []interface{}{float64(i + 1)})
+		} else {
+			c.Assert(msg["args"], DeepEquals, []interface{}{})
+		}
+	}
+
+	_, err = client.EnqueueBulk("", "bulk", args)
+	c.Assert(err, Equals, ErrMissingClass)
+}
+
+// a worker that takes Sidekiq-style positional args
+type ArgsWorker []interface{}
+
+func (w *ArgsWorker) Perform() error {
+	if len(*w) > 0 && (*w)[0] == "fail" {
+		return errors.New("failed")
+	}
+	return nil
+}
+
+func (s *ClientSuite) TestUniqueJobs(c *C) {
+	client := newTestClient(c)
+	client.Unique("UntilFinished", UniqueUntilFinished, time.Minute)
+	client.Unique("UntilStarted", UniqueUntilStarted, time.Minute)
+	w := NewWorkerConfig()
+	MaybeFail(c, w.RegisterName("UntilFinished", &ArgsWorker{}))
+	MaybeFail(c, w.RegisterName("UntilStarted", &ArgsWorker{}))
+	perform := func(queue string) {
+		data, err := redis.Bytes(client.redisQuery("LPOP", "queue:"+queue))
+		MaybeFail(c, err)
+		job := &Job{}
+		MaybeFail(c, job.FromJSON(data))
+		w.process(job, "test")
+	}
+
+	enqueue := func(class, queue string, args ...interface{}) error {
+		_, err := client.Enqueue(class, queue, args...)
+		return err
+	}
+	MaybeFail(c, enqueue("UntilFinished", "", "bob"))
+	c.Assert(enqueue("UntilFinished", "", "bob"), Equals, ErrDuplicateJob)
+	MaybeFail(c, enqueue("UntilFinished", "", "alice"))
+	MaybeFail(c, enqueue("UntilFinished", "low", "bob"))
+	MaybeFail(c, enqueue("NotUnique", "", "bob"))
+	MaybeFail(c, enqueue("NotUnique", "", "bob"))
+
+	// the lock is released when the job succeeds
+	perform("default")
+	MaybeFail(c, enqueue("UntilFinished", "", "bob"))
+
+	// or when it starts
+	MaybeFail(c, enqueue("UntilStarted", "started", "fail"))
+	c.Assert(enqueue("UntilStarted", "started", "fail"), Equals, ErrDuplicateJob)
+	perform("started")
+	MaybeFail(c, enqueue("UntilStarted", "started", "fail"))
+
+	// or when it fails for good, by running out of retries
+	_, err := client.Push("UntilFinished", []interface{}{"fail"}, WithQueue("once"), WithRetry(0))
+	MaybeFail(c, err)
+	perform("once")
+	MaybeFail(c, enqueue("UntilFinished", "once", "fail"))
+
+	// or by being moved to the dead set
+	w.RegisterValidator("UntilFinished", func(json.RawMessage) error { return errors.New("invalid") })
+	MaybeFail(c, enqueue("UntilFinished", "invalid", "carol"))
+	c.Assert(enqueue("UntilFinished", "invalid", "carol"), Equals, ErrDuplicateJob)
+	perform("invalid")
+	dead, err := redis.Int(client.redisQuery("ZCARD", "dead"))
+	MaybeFail(c, err)
+	c.Assert(dead, Equals, 1)
+	MaybeFail(c, enqueue("UntilFinished", "invalid", "carol"))
+}
+
+func (s *ClientSuite) TestBatch(c *C) {
+	client := newTestClient(c)
+	client.Unique("UniqueWorker", UniqueUntilFinished, time.Minute)
+	batch := client.Batch()
+	jid, err := batch.Enqueue("HardWorker", "", "bob")
+	MaybeFail(c, err)
+	_, err = batch.Enqueue("UniqueWorker", "critical", "alice")
+	MaybeFail(c, err)
+	_, err = batch.EnqueueAt(time.Now().Add(time.Hour), "HardWorker", "", "later")
+	MaybeFail(c, err)
+	_, err = batch.Enqueue("", "")
+	c.Assert(err, Equals, ErrMissingClass)
+	c.Assert(batch.Len(), Equals, 3)
+
+	count := func(command, key string) int {
+		n, err := redis.Int(client.redisQuery(command, key))
+		MaybeFail(c, err)
+		return n
+	}
+	c.Assert(count("LLEN", "queue:default"), Equals, 0)
+	MaybeFail(c, batch.Commit())
+	c.Assert(batch.Len(), Equals, 0)
+	c.Assert(count("LLEN", "queue:default"), Equals, 1)
+	c.Assert(count("LLEN", "queue:critical"), Equals, 1)
+	c.Assert(count("ZCARD", "schedule"), Equals, 1)
+	data, err := redis.Bytes(client.redisQuery("LINDEX", "queue:default", 0))
+	MaybeFail(c, err)
+	job := &Job{}
+	MaybeFail(c, job.FromJSON(data))
+	c.Assert(job.ID, Equals, jid)
+
+	// a duplicate unique job keeps the whole batch from being pushed
+	batch.Enqueue("HardWorker", "", "carol")
+	batch.Enqueue("UniqueWorker", "critical", "alice")
+	c.Assert(batch.Commit(), Equals, ErrDuplicateJob)
+	c.Assert(batch.Len(), Equals, 2)
+	c.Assert(count("LLEN", "queue:default"), Equals, 1)
+
+	// a push that fails inside the transaction doesn't undo the others
+	batch = client.Batch()
+	batch.Enqueue("HardWorker", "", "dave")
+	jid, _ = batch.Enqueue("HardWorker", "broken", "erin")
+	_, err = client.redisQuery("SET", "queue:broken", "not a list")
+	MaybeFail(c, err)
+	err = batch.Commit()
+	c.Assert(err, FitsTypeOf, BatchError{})
+	c.Assert(err.(BatchError).Errors, HasLen, 1)
+	c.Assert(err.(BatchError).Errors[jid], NotNil)
+	c.Assert(err, ErrorMatches, "gokiq: 1 jobs in batch failed to push: "+jid+": WRONGTYPE.*")
+	c.Assert(batch.Len(), Equals, 1)
+	c.Assert(count("LLEN", "queue:default"), Equals, 2)
+}
+
+func (s *ClientSuite) TestMiddleware(c *C) {
+	client := newTestClient(c)
+	client.Register(&EmailWorker{}, "", 5)
+	var order []string
+	client.Use(func(payload map[string]interface{}, next func() error) error {
+		order = append(order, "tenant")
+		payload["tenant_id"] = "acme"
+		return next()
+	}, func(payload map[string]interface{}, next func() error) error {
+		order = append(order, "filter")
+		if payload["class"] == "Dropped" {
+			return nil
+		}
+		if payload["queue"] == "default" {
+			payload["queue"] = "acme"
+		}
+		return next()
+	})
+
+	_, err := client.Enqueue("HardWorker", "", "bob")
+	MaybeFail(c, err)
+	_, err = client.Enqueue("Dropped", "")
+	MaybeFail(c, err)
+	MaybeFail(c, client.QueueJob(&EmailWorker{"user@example.com"}))
+	_, err = client.EnqueueBulk("HardWorker", "", [][]interface{}{{"alice"}})
+	MaybeFail(c, err)
+	for _, err := range client.QueueJobs([]Worker{&EmailWorker{"other@example.com"}}) {
+		MaybeFail(c, err)
+	}
+	c.Assert(order[:4], DeepEquals, []string{"tenant", "filter", "tenant", "filter"})
+
+	for queue, expected := range map[string]int{"acme": 2, "emails": 2, "default": 0} {
+		payloads, err := redis.ByteSlices(client.redisQuery("LRANGE", "queue:"+queue, 0, -1))
+		MaybeFail(c, err)
+		c.Assert(payloads, HasLen, expected)
+		for _, data := range payloads {
+			var msg map[string]interface{}
+			MaybeFail(c, json.Unmarshal(data, &msg))
+			c.Assert(msg["tenant_id"], Equals, "acme")
+			c.Assert(msg["class"], Not(Equals), "Dropped")
+		}
+	}
+}
+
+type ReportWorker struct{ ID int }
+
+func (w *ReportWorker) Perform() error { return nil }
+
+type InvoiceWorker struct{ ID int }
+
+func (w *InvoiceWorker) Perform() error { return nil }
+
+func (s *ClientSuite) TestQueueJobs(c *C) {
+	client := newTestClient(c)
+	client.BulkParallelism = 2
+	client.Register(&EmailWorker{}, "", 5)
+	client.Register(&ReportWorker{}, "reports", 5)
+	client.Register(&InvoiceWorker{}, "invoices", 5)
+
+	var workers []Worker
+	for i := 0; i < 5; i++ {
+		workers = append(workers, &EmailWorker{strconv.Itoa(i)}, &ReportWorker{i}, &InvoiceWorker{i})
+	}
+	workers = append(workers, &TestWorker{}, nil)
+	errs := client.QueueJobs(workers)
+	c.Assert(errs, HasLen, len(workers))
+	for _, err := range errs[:15] {
+		MaybeFail(c, err)
+	}
+	c.Assert(errs[15], ErrorMatches, "gokiq: Unregistered worker type .*")
+	c.Assert(errs[16], Equals, ErrNilWorker)
+
+	expected := map[string][]string{"emails": {}, "reports": {}, "invoices": {}}
+	for i := 0; i < 5; i++ {
+		expected["emails"] = append(expected["emails"], fmt.Sprintf(`{"Address":"%d"}`, i))
+		expected["reports"] = append(expected["reports"], fmt.Sprintf(`{"ID":%d}`, i))
+		expected["invoices"] = append(expected["invoices"], fmt.Sprintf(`{"ID":%d}`, i))
+	}
+	for queue, args := range expected {
+		entries, err := redis.Values(client.redisQuery("LRANGE", "queue:"+queue, 0, -1))
+		MaybeFail(c, err)
+		c.Assert(entries, HasLen, len(args))
+		for i, entry := range entries {
+			job := &Job{}
+			MaybeFail(c, job.FromJSON(entry.([]byte)))
+			c.Assert(string(*job.Args), Equals, args[i])
+		}
+	}
+}
+
+func benchmarkQueueJobs(c *C, bulk bool) {
+	client := newTestClient(c)
+	client.BulkParallelism = 3
+	client.Register(&EmailWorker{}, "", 5)
+	client.Register(&ReportWorker{}, "reports", 5)
+	client.Register(&InvoiceWorker{}, "invoices", 5)
+	var workers []Worker
+	for i := 0; i < 30; i++ {
+		workers = append(workers, &EmailWorker{strconv.Itoa(i)}, &ReportWorker{i}, &InvoiceWorker{i})
+	}
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		if bulk {
+			client.QueueJobs(workers)
+			continue
+		}
+		for _, worker := range workers {
+			client.QueueJob(worker)
+		}
+	}
+}
+
+func (s *ClientSuite) BenchmarkQueueJobLoop(c *C) { benchmarkQueueJobs(c, false) }
+func (s *ClientSuite) BenchmarkQueueJobs(c *C)    { benchmarkQueueJobs(c, true) }
+
+// counts the commands sent on a connection
+type countingConn struct {
+	redis.Conn
+	counts map[string]int
+}
+
+func (c countingConn) Do(command string, args ...interface{}) (interface{}, error) {
+	c.counts[command]++
+	return c.Conn.Do(command, args...)
+}
+
+func (s *ClientSuite) TestQueuesAddedOnce(c *C) {
+	newTestClient(c)
+	client := NewClientConfig()
+	counts := make(map[string]int)
+	client.RedisPool = redis.NewPool(func() (redis.Conn, error) {
+		conn, err := redis.Dial("tcp", defaultRedisServer)
+		return countingConn{conn, counts}, err
+	}, 1)
+
+	client.Register(&EmailWorker{}, "", 5)
+	for i := 0; i < 3; i++ {
+		MaybeFail(c, client.QueueJob(&EmailWorker{"user@example.com"}))
+		MaybeFail(c, client.QueueJobConfig(&EmailWorker{"user@example.com"}, JobConfig{Queue: "bulk"}))
+	}
+
+	c.Assert(counts["SADD"], Equals, 2)
+	queues, err := redis.Strings(client.redisQuery("SMEMBERS", "queues"))
+	MaybeFail(c, err)
+	sort.Strings(queues)
+	c.Assert(queues, DeepEquals, []string{"bulk", "emails"})
+}
+
+func (s *ClientSuite) TestPoolStats(c *C) {
+	newTestClient(c)
+	client := NewClientConfig()
+	client.PoolSize = 2
+	client.Register(&EmailWorker{}, "", 5)
+
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() { errs <- client.QueueJob(&EmailWorker{"user@example.com"}) }()
+	}
+	for i := 0; i < 10; i++ {
+		MaybeFail(c, <-errs)
+	}
+
+	stats := client.PoolStats()
+	c.Assert(stats.Gets >= 10, Equals, true)
+	if stats.Active > 2 {
+		c.Fatalf("Expected at most 2 connections, got %d", stats.Active)
+	}
+	queued, err := redis.Int(client.redisQuery("LLEN", "queue:emails"))
+	MaybeFail(c, err)
+	c.Assert(queued, Equals, 10)
+}
+
+func (s *ClientSuite) TestRedisServer(c *C) {
+	newTestClient(c)
+	client := NewClientConfig()
+	client.RedisServer = "redis://127.0.0.1:6379/1"
+	jid, err := client.Enqueue("HardWorker", "", "bob")
+	MaybeFail(c, err)
+	defer client.redisQuery("FLUSHDB")
+
+	data, err := redis.Bytes(client.redisQuery("LPOP", "queue:default"))
+	MaybeFail(c, err)
+	job := &Job{}
+	MaybeFail(c, job.FromJSON(data))
+	c.Assert(job.ID, Equals, jid)
+	queued, err := redis.Int(NewWorkerConfig().redisQuery("LLEN", "queue:default"))
+	MaybeFail(c, err)
+	c.Assert(queued, Equals, 0)
+
+	client = NewClientConfig()
+	client.RedisServer = "127.0.0.1:1"
+	_, err = client.Enqueue("HardWorker", "", "bob")
+	c.Assert(err, NotNil)
+}
+
+func benchmarkConcurrentQueueJob(c *C, poolSize int) {
+	newTestClient(c)
+	client := NewClientConfig()
+	client.PoolSize = poolSize
+	client.Register(&EmailWorker{}, "", 5)
+	client.initOnce.Do(client.init)
+
+	jobs := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				client.QueueJob(&EmailWorker{"user@example.com"})
+			}
+		}()
+	}
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	wg.Wait()
+	c.StopTimer()
+	c.Logf("pool size %d waited %s for %d connections", poolSize, client.PoolStats().Wait, client.PoolStats().Gets)
+}
+
+func (s *ClientSuite) BenchmarkConcurrentQueueJobPool1(c *C)  { benchmarkConcurrentQueueJob(c, 1) }
+func (s *ClientSuite) BenchmarkConcurrentQueueJobPool4(c *C)  { benchmarkConcurrentQueueJob(c, 4) }
+func (s *ClientSuite) BenchmarkConcurrentQueueJobPool16(c *C) { benchmarkConcurrentQueueJob(c, 16) }
+
+func (s *ClientSuite) TestWindowNext(c *C) {
+	hours := func(h float64) time.Duration { return time.Duration(h * float64(time.Hour)) }
+	at := func(day, hour int) time.Time { return time.Date(2024, time.January, day, hour, 0, 0, 0, time.UTC) } // the 1st is a Monday
+	business := WindowSpec{Start: hours(9), End: hours(17), Days: []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}}
+	night := WindowSpec{Start: hours(22), End: hours(6)}
+
+	for _, t := range []struct {
+		window   WindowSpec
+		now      time.Time
+		expected time.Time
+	}{
+		{business, at(1, 10), at(1, 10)},
+		{business, at(1, 7), at(1, 9)},
+		{business, at(1, 17), at(2, 9)},
+		{business, at(5, 18), at(8, 9)}, // Friday evening
+		{business, at(6, 12), at(8, 9)}, // Saturday
+		{night, at(1, 23), at(1, 23)},
+		{night, at(2, 3), at(2, 3)},
+		{night, at(2, 12), at(2, 22)},
+		{WindowSpec{Start: hours(1), End: hours(2), Days: []time.Weekday{}}, at(1, 0), at(1, 1)},
+	} {
+		c.Assert(t.window.Next(t.now), Equals, t.expected, Commentf("%+v at %s", t.window, t.now))
+	}
+}
+
+func (s *ClientSuite) TestEnqueueInWindow(c *C) {
+	client := newTestClient(c)
+	now := time.Now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	start := now.Add(2*time.Hour).Sub(midnight) % (24 * time.Hour)
+	window := WindowSpec{Start: start, End: start + time.Hour, Location: time.UTC}
+
+	_, err := client.EnqueueInWindow(window, "ReportWorker", 1)
+	MaybeFail(c, err)
+	queued, err := redis.Int(client.redisQuery("LLEN", "queue:default"))
+	MaybeFail(c, err)
+	c.Assert(queued, Equals, 0)
+	scheduled, err := redis.Values(client.redisQuery("ZRANGE", "schedule", 0, -1, "WITHSCORES"))
+	MaybeFail(c, err)
+	c.Assert(scheduled, HasLen, 2)
+	score, err := redis.Float64(scheduled[1], nil)
+	MaybeFail(c, err)
+	if diff := score - timeFloat(now.Add(2*time.Hour)); diff < -0.001 || diff > 0.001 {
+		c.Fatalf("Expected the job to be scheduled for the window's start, it is %fs off", diff)
+	}
+
+	window = WindowSpec{Start: 0, End: 0} // all day
+	_, err = client.EnqueueInWindow(window, "ReportWorker", 2)
+	MaybeFail(c, err)
+	queued, err = redis.Int(client.redisQuery("LLEN", "queue:default"))
+	MaybeFail(c, err)
+	c.Assert(queued, Equals, 1)
+
+	// args that can't be marshaled are an error, not a panic
+	_, err = client.EnqueueInWindow(window, "ReportWorker", make(chan int))
+	c.Assert(err, NotNil)
+	_, err = client.EnqueueInWindow(window, "")
+	c.Assert(err, Equals, ErrMissingClass)
+}
@@ -0,0 +1,74 @@
+package gokiq
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// dials RedisServer for the default pools
+func (w *WorkerConfig) dial() (redis.Conn, error) {
+	return dialServer(w.RedisServer)
+}
+
+// dials a host:port or redis:// URL, or the default server if it is empty
+func dialServer(server string) (redis.Conn, error) {
+	if server == "" {
+		server = defaultRedisServer
+	}
+	if strings.Contains(server, "://") {
+		return redis.DialURL(server)
+	}
+	return redis.Dial("tcp", server)
+}
+
+// ConfigJSON returns the configuration of the worker as JSON for diagnostics.
+// Callbacks and pools are left out, and the password in RedisServer is
+// redacted.
+func (w *WorkerConfig) ConfigJSON() []byte {
+	server := w.RedisServer
+	if server == "" {
+		server = defaultRedisServer
+	}
+	data, _ := json.Marshal(struct {
+		RedisServer    string      `json:"redis_server"`
+		RedisNamespace string      `json:"redis_namespace"`
+		Queues         QueueConfig `json:"queues"`
+		WorkerCount    int         `json:"worker_count"`
+		PollInterval   string      `json:"poll_interval"`
+		StopTimeout    string      `json:"stop_timeout"`
+		JobTimeout     string      `json:"job_timeout"`
+		WorkerMaxJobs  int         `json:"worker_max_jobs"`
+	}{
+		RedisServer:    redactURL(server),
+		RedisNamespace: w.RedisNamespace,
+		Queues:         w.Queues,
+		WorkerCount:    w.WorkerCount,
+		PollInterval:   w.PollInterval.String(),
+		StopTimeout:    w.StopTimeout.String(),
+		JobTimeout:     w.JobTimeout.String(),
+		WorkerMaxJobs:  w.WorkerMaxJobs,
+	})
+	return data
+}
+
+// replaces the password in a redis:// URL. A server that can't be parsed has
+// everything before its host redacted, since it could hold a password.
+func redactURL(server string) string {
+	u, err := url.Parse(server)
+	if err != nil {
+		if i := strings.LastIndex(server, "@"); i >= 0 {
+			return "REDACTED@" + server[i+1:]
+		}
+		return server
+	}
+	if u.User == nil {
+		return server
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "REDACTED")
+	}
+	return u.String()
+}
@@ -0,0 +1,82 @@
+package gokiq
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+)
+
+// ContextWorker is implemented by workers that take the job's args as they
+// were pushed, like a Sidekiq worker's perform, along with a context that
+// expires after the job's timeout and is cancelled when Shutdown's StopTimeout
+// runs out, so that a long job can stop cleanly. Returning the context's error
+// then puts the job back on its queue instead of retrying it. See
+// RegisterContext.
+type ContextWorker interface {
+	Perform(ctx context.Context, args []interface{}) error
+}
+
+// RegisterContext registers a ContextWorker for the named worker class. Perform
+// is called on the registered worker for every job, from as many goroutines as
+// there are workers, so it shouldn't keep state for a job in the worker. Args
+// that are a JSON object instead of an array are passed as the only arg.
+func (w *WorkerConfig) RegisterContext(name string, worker ContextWorker) error {
+	if worker == nil {
+		return ErrNilWorker
+	}
+	if val := reflect.ValueOf(worker); val.Kind() == reflect.Ptr && val.IsNil() {
+		return ErrNilWorker
+	}
+	pool := &workerPool{resettable: true}
+	pool.New = func() interface{} {
+		return &contextWorker{worker: worker, useNumber: w.UseNumber}
+	}
+
+	w.mappingMtx.Lock()
+	w.workerMapping[name] = reflect.TypeOf(contextWorker{})
+	w.atMostOnce[name] = false
+	w.workerPools[name] = pool
+	w.mappingMtx.Unlock()
+	return nil
+}
+
+// performs jobs by calling a worker registered with RegisterContext
+type contextWorker struct {
+	Ctx context.Context // set by setJob
+
+	worker    ContextWorker
+	useNumber bool
+	args      []byte
+}
+
+// keeps the args to be decoded by Perform
+func (cw *contextWorker) UnmarshalJSON(data []byte) error {
+	cw.args = append(cw.args[:0], data...)
+	return nil
+}
+
+func (cw *contextWorker) Perform() error {
+	var args []interface{}
+	if data := bytes.TrimSpace(cw.args); len(data) > 0 && data[0] != '[' {
+		var arg interface{}
+		if err := unmarshalArg(data, &arg, cw.useNumber); err != nil {
+			return err
+		}
+		args = []interface{}{arg}
+	} else if err := unmarshalArg(data, &args, cw.useNumber); err != nil {
+		return err
+	}
+	if args == nil {
+		args = []interface{}{}
+	}
+	ctx := cw.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return cw.worker.Perform(ctx, args)
+}
+
+func (cw *contextWorker) Reset() {
+	cw.args = cw.args[:0]
+	cw.Ctx = nil
+}
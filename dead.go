@@ -0,0 +1,129 @@
+package gokiq
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// moves a job from the dead set back onto a queue, unless it has already been removed
+var replayScript = redis.NewScript(2, `
+if redis.call("ZREM", KEYS[1], ARGV[1]) == 1 then
+  return redis.call("RPUSH", KEYS[2], ARGV[1])
+end
+return 0`)
+
+// moves a job that will never be retried into the dead set, releasing its
+// unique lock
+func (w *WorkerConfig) killJob(job *Job, err error) {
+	w.unlockUnique(job, job.UniqueUntil)
+	job.ErrorType = fmt.Sprintf("%T", err)
+	job.ErrorMessage = err.Error()
+	if !job.hasFailed() {
+		job.FailedAt, job.FailedAtFloat = w.timestamp(time.Now())
+	}
+
+	conn := w.RedisPool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("ZADD", w.nsKey("dead"), strconv.FormatFloat(timeFloat(time.Now()), 'f', -1, 64), job.JSON())
+	conn.Send("ZREMRANGEBYRANK", w.nsKey("dead"), 0, -maxDeadJobs-1)
+	if _, err := conn.Do("EXEC"); err != nil {
+		w.handleError(err)
+	}
+	w.emitEvent(EventDead, job)
+	log.Printf("event=job_dead job_id=%s job_type=%s queue=%s pid=%d", job.ID, job.Type, job.Queue, pid)
+}
+
+// ReplayDead pushes the jobs in the dead set that match filter back onto their
+// queues and removes them from the dead set. A nil filter replays every job.
+// It returns the number of jobs replayed.
+func (w *WorkerConfig) ReplayDead(filter func(*Job) bool) (int, error) {
+	conn := w.RedisPool.Get()
+	defer conn.Close()
+
+	key := w.nsKey("dead")
+	entries, err := redis.Values(conn.Do("ZRANGE", key, 0, -1))
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, entry := range entries {
+		data := entry.([]byte)
+		job := &Job{}
+		if err := job.FromJSON(data); err != nil {
+			w.handleError(err)
+			continue
+		}
+		if filter != nil && !filter(job) {
+			continue
+		}
+		if job.Queue == "" {
+			job.Queue = "default"
+		}
+
+		n, err := redis.Int(replayScript.Do(conn, key, w.nsKey("queue:"+job.Queue), data))
+		if err != nil {
+			return count, err
+		}
+		if n > 0 {
+			count++
+			log.Printf("event=job_replay job_id=%s job_type=%s queue=%s pid=%d", job.ID, job.Type, job.Queue, pid)
+		}
+	}
+	return count, nil
+}
+
+// ScheduledJob is a job in one of the sorted sets, with the time it is scored
+// at: when it is due for the retry and schedule sets, and when it died for the
+// dead set.
+type ScheduledJob struct {
+	*Job
+	At time.Time
+}
+
+// DeadSet returns the jobs in the dead set, oldest first.
+func (w *WorkerConfig) DeadSet() ([]ScheduledJob, error) {
+	entries, err := redis.Values(w.redisQuery("ZRANGE", w.nsKey("dead"), 0, -1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]ScheduledJob, 0, len(entries)/2)
+	for i := 0; i < len(entries); i += 2 {
+		job := &Job{}
+		if err := job.FromJSON(entries[i].([]byte)); err != nil {
+			return nil, err
+		}
+		score, err := redis.Float64(entries[i+1], nil)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, ScheduledJob{Job: job, At: time.Unix(0, int64(score*float64(time.Second)))})
+	}
+	return jobs, nil
+}
+
+// ClearDead removes every job from the dead set and returns how many there were.
+func (w *WorkerConfig) ClearDead() (int, error) {
+	conn := w.RedisPool.Get()
+	defer conn.Close()
+
+	key := w.nsKey("dead")
+	conn.Send("MULTI")
+	conn.Send("ZCARD", key)
+	conn.Send("DEL", key)
+	res, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+	count, err := redis.Int(res[0], nil)
+	if count > 0 {
+		log.Printf("event=dead_cleared count=%d pid=%d", count, pid)
+	}
+	return count, err
+}
@@ -0,0 +1,93 @@
+package gokiq
+
+import (
+	"log"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// lifecycle events XADDed to an EventStream
+const (
+	EventEnqueued = "enqueued"
+	EventStarted  = "started"
+	EventFinished = "finished"
+	EventFailed   = "failed"
+	EventDead     = "dead"
+	EventRetried  = "retried" // moved from a retry set back onto its queue
+)
+
+// streams are trimmed to about this many events
+const eventStreamMaxLen = 10000
+
+func addEvent(conn redis.Conn, stream, event string, job *Job, queue string) error {
+	_, err := conn.Do("XADD", stream, "MAXLEN", "~", eventStreamMaxLen, "*",
+		"event", event, "jid", job.ID, "class", job.Type, "queue", queue)
+	return err
+}
+
+func (w *WorkerConfig) emitEvent(event string, job *Job) {
+	if w.EventStream == "" {
+		return
+	}
+	conn := w.RedisPool.Get()
+	defer conn.Close()
+	if err := addEvent(conn, w.nsKey(w.EventStream), event, job, job.Queue); err != nil {
+		w.handleError(err)
+	}
+}
+
+// adds an event for a job that has been pushed. A failure is only logged, since
+// returning it would make callers that retry push the job again.
+func (c *ClientConfig) emitEvent(event string, job *Job, queue string) {
+	if c.EventStream == "" {
+		return
+	}
+	conn := c.getConn()
+	defer conn.Close()
+	if err := addEvent(conn, c.nsKey(c.EventStream), event, job, queue); err != nil {
+		log.Printf("event=event_stream_error stream_event=%s job_id=%s job_type=%s queue=%s error_message=%q pid=%d", event, job.ID, job.Type, queue, err, pid)
+	}
+}
+
+// JobDone is sent to subscribers as each job finishes.
+type JobDone struct {
+	ID      string
+	Type    string
+	Success bool
+}
+
+type subscriber struct {
+	ch    chan JobDone
+	block bool
+}
+
+// Subscribe returns a channel that receives a JobDone for each job that this
+// process finishes. The channel buffers up to size events; when it is full,
+// events are dropped, or if block is set, the worker waits until there is
+// room. The channel is never closed.
+func (w *WorkerConfig) Subscribe(size int, block bool) <-chan JobDone {
+	ch := make(chan JobDone, size)
+	w.subscriberMtx.Lock()
+	w.subscribers = append(w.subscribers, subscriber{ch, block})
+	w.subscriberMtx.Unlock()
+	return ch
+}
+
+func (w *WorkerConfig) notifySubscribers(job *Job, success bool) {
+	w.subscriberMtx.RLock()
+	subscribers := w.subscribers
+	w.subscriberMtx.RUnlock()
+
+	done := JobDone{ID: job.ID, Type: job.Type, Success: success}
+	for _, sub := range subscribers {
+		if sub.block {
+			sub.ch <- done
+			continue
+		}
+		select {
+		case sub.ch <- done:
+		default:
+			log.Printf("event=subscriber_full job_id=%s pid=%d", job.ID, pid)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"log"
 	"time"
 
 	"github.com/cupcake/gokiq"
@@ -22,5 +23,7 @@ func doSomething(i int) {
 func main() {
 	gokiq.Workers.Register(&ExampleWorker{})
 	gokiq.Workers.WorkerCount = 200
-	gokiq.Workers.Run()
+	if err := gokiq.Workers.Run(); err != nil {
+		log.Fatal(err)
+	}
 }
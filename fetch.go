@@ -0,0 +1,283 @@
+package gokiq
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Fetcher takes the next job off the queues for Run to dispatch. Fetch returns
+// a nil job if none became available before the fetch timed out.
+type Fetcher interface {
+	Fetch(ctx context.Context) (*Job, error)
+}
+
+type weightedFetcher struct{ w *WorkerConfig }
+
+// WeightedFetcher returns a Fetcher that checks the queues in a random order
+// on each fetch, favoring queues in proportion to their weight.
+func WeightedFetcher(w *WorkerConfig) Fetcher {
+	return weightedFetcher{w}
+}
+
+func (f weightedFetcher) Fetch(ctx context.Context) (*Job, error) {
+	return f.w.fetch(ctx, f.w.queueList())
+}
+
+type strictFetcher struct{ w *WorkerConfig }
+
+// StrictFetcher returns a Fetcher that always checks the queues in order of
+// descending weight, so a queue is only fetched from when all queues with a
+// higher weight are empty.
+func StrictFetcher(w *WorkerConfig) Fetcher {
+	return strictFetcher{w}
+}
+
+func (f strictFetcher) Fetch(ctx context.Context) (*Job, error) {
+	names := f.w.queuesByWeight()
+	queues := make([]interface{}, 0, len(names))
+	for _, queue := range names {
+		if key := f.w.nsKey("queue:" + queue); !f.w.skipped(key) {
+			queues = append(queues, key)
+		}
+	}
+	return f.w.fetch(ctx, queues)
+}
+
+// returns the names of the configured queues from the highest weight to the lowest
+func (w *WorkerConfig) queuesByWeight() []string {
+	names := make([]string, 0, len(w.Queues))
+	for queue := range w.Queues {
+		names = append(names, queue)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if w.Queues[names[i]] == w.Queues[names[j]] {
+			return names[i] < names[j]
+		}
+		return w.Queues[names[i]] > w.Queues[names[j]]
+	})
+	return names
+}
+
+// pops a job off the first non-empty queue in the list of namespaced queue keys
+func (w *WorkerConfig) fetch(ctx context.Context, queues []interface{}) (*Job, error) {
+	if len(queues) == 0 {
+		if !w.orderedBusy() {
+			return nil, ErrNoQueues
+		}
+		// every queue is ordered and has a job in progress
+		select {
+		case <-w.orderedFree:
+		case <-ctx.Done():
+		case <-time.After(w.FetchTimeout):
+		}
+		return nil, nil
+	}
+	if len(w.SortedQueues) > 0 {
+		if job, err := w.popSorted(queues); job != nil || err != nil {
+			return job, err
+		}
+	}
+	// block for a second at a time, so that a cancelled ctx, like Shutdown's,
+	// doesn't wait out the whole FetchTimeout
+	var msg []interface{}
+	var err error
+	for waited := 0; waited < w.fetchTimeout(); waited++ {
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+		msg, err = redis.Values(w.redisQuery("BLPOP", append(queues, redisTimeout)...))
+		if err != redis.ErrNil {
+			break
+		}
+	}
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "WRONGTYPE") {
+			w.checkQueueTypes(queues)
+		}
+		return nil, err
+	}
+
+	job := &Job{}
+	if err = job.FromJSON(msg[1].([]byte)); err != nil {
+		return nil, err
+	}
+	job.Queue = w.queueName(string(msg[0].([]byte)))
+	return job, nil
+}
+
+// returns the name of the queue with the given namespaced key
+func (w *WorkerConfig) queueName(key string) string {
+	return key[len(w.nsKey("queue:")):]
+}
+
+// BLPOP's timeout in seconds, where zero would block forever
+func (w *WorkerConfig) fetchTimeout() int {
+	if w.FetchTimeout <= 0 {
+		return redisTimeout
+	}
+	return int(math.Ceil(w.FetchTimeout.Seconds()))
+}
+
+// logs the queue keys that aren't lists, which make BLPOP fail with WRONGTYPE,
+// and stops fetching from them if SkipInvalidQueues is set
+func (w *WorkerConfig) checkQueueTypes(queues []interface{}) {
+	for _, key := range queues {
+		typ, err := redis.String(w.redisQuery("TYPE", key))
+		if err != nil || typ == "list" || typ == "none" {
+			continue
+		}
+		log.Printf("event=queue_wrong_type key=%s type=%s skipped=%t pid=%d", key, typ, w.SkipInvalidQueues, pid)
+		if w.SkipInvalidQueues {
+			w.queueMtx.Lock()
+			if w.skippedQueues == nil {
+				w.skippedQueues = make(map[string]bool)
+			}
+			w.skippedQueues[key.(string)] = true
+			w.queueMtx.Unlock()
+		}
+	}
+}
+
+func (w *WorkerConfig) skipped(key string) bool {
+	w.queueMtx.RLock()
+	defer w.queueMtx.RUnlock()
+	return w.skippedQueues[key] || w.busyQueues[key]
+}
+
+func (w *WorkerConfig) isOrdered(queue string) bool {
+	for _, ordered := range w.OrderedQueues {
+		if ordered == queue {
+			return true
+		}
+	}
+	return false
+}
+
+// marks an ordered queue as having a job in progress, so that the fetchers
+// skip it until the job is done
+func (w *WorkerConfig) setQueueBusy(queue string, busy bool) {
+	if !w.isOrdered(queue) {
+		return
+	}
+	w.queueMtx.Lock()
+	if w.busyQueues == nil {
+		w.busyQueues = make(map[string]bool)
+	}
+	w.busyQueues[w.nsKey("queue:"+queue)] = busy
+	w.queueMtx.Unlock()
+	if !busy {
+		select {
+		case w.orderedFree <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (w *WorkerConfig) orderedBusy() bool {
+	w.queueMtx.RLock()
+	defer w.queueMtx.RUnlock()
+	for _, busy := range w.busyQueues {
+		if busy {
+			return true
+		}
+	}
+	return false
+}
+
+// create a slice of queues with duplicates using the assigned frequencies,
+// multiplied by any boosts
+func (w *WorkerConfig) denormalizeQueues() {
+	w.queueMtx.Lock()
+	defer w.queueMtx.Unlock()
+	w.randomQueues = nil
+	for queue, x := range w.Queues {
+		if w.isPriority(queue) {
+			continue // fetched by priorityFetcher
+		}
+		if boost, ok := w.boosts[queue]; ok {
+			x *= boost.multiplier
+		}
+		for i := 0; i < x; i++ {
+			w.randomQueues = append(w.randomQueues, w.nsKey("queue:"+queue))
+		}
+	}
+}
+
+type queueBoost struct{ multiplier int }
+
+// BoostQueue multiplies the weight of a queue by multiplier for ttl, so that a
+// backlog can be drained sooner without restarting with a new QueueConfig.
+// A new boost of the same queue replaces the previous one. The multiplier must
+// be at least one and the ttl positive.
+func (w *WorkerConfig) BoostQueue(name string, multiplier int, ttl time.Duration) error {
+	if _, ok := w.Queues[name]; !ok {
+		return fmt.Errorf("gokiq: Unknown queue %q", name)
+	}
+	if multiplier < 1 {
+		return fmt.Errorf("gokiq: Invalid boost multiplier %d", multiplier)
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("gokiq: Invalid boost ttl %s", ttl)
+	}
+	boost := &queueBoost{multiplier}
+	w.queueMtx.Lock()
+	if w.boosts == nil {
+		w.boosts = make(map[string]*queueBoost)
+	}
+	w.boosts[name] = boost
+	w.queueMtx.Unlock()
+	w.denormalizeQueues()
+	log.Printf("event=queue_boost queue=%s multiplier=%d ttl=%s pid=%d", name, multiplier, ttl, pid)
+
+	time.AfterFunc(ttl, func() {
+		w.queueMtx.Lock()
+		current := w.boosts[name] == boost
+		if current {
+			delete(w.boosts, name)
+		}
+		w.queueMtx.Unlock()
+		if current {
+			w.denormalizeQueues()
+			log.Printf("event=queue_boost_end queue=%s pid=%d", name, pid)
+		}
+	})
+	return nil
+}
+
+// get a random slice of unique queues from the slice of denormalized queues
+func (w *WorkerConfig) queueList() []interface{} {
+	size := len(w.Queues)
+	res := make([]interface{}, 0, size)
+	queues := make(map[string]struct{}, size)
+
+	w.queueMtx.RLock()
+	randomQueues := w.randomQueues
+	w.queueMtx.RUnlock()
+	indices := rand.Perm(len(randomQueues))
+	if len(indices) > size {
+		indices = indices[:size]
+	}
+	for _, i := range indices {
+		queue := randomQueues[i]
+		if w.skipped(queue) {
+			continue
+		}
+		if _, ok := queues[queue]; !ok {
+			queues[queue] = struct{}{}
+			res = append(res, queue)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,21 @@
+//go:build go1.18
+// +build go1.18
+
+package gokiq
+
+// TypedWorker is implemented by workers whose Perform takes the job's args
+// decoded into a T, see RegisterWorker.
+type TypedWorker[T any] interface {
+	Perform(args T) error
+}
+
+// RegisterWorker registers a TypedWorker for the named worker class. The args
+// of each job are decoded into a T as described for RegisterTyped. Perform is
+// called on the registered worker for every job, from as many goroutines as
+// there are workers, so it shouldn't keep state for a job in the worker.
+func RegisterWorker[T any](w *WorkerConfig, name string, worker TypedWorker[T]) error {
+	if worker == nil {
+		return ErrNilWorker
+	}
+	return w.RegisterTyped(name, func(args T) error { return worker.Perform(args) })
+}
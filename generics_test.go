@@ -0,0 +1,28 @@
+//go:build go1.18
+// +build go1.18
+
+package gokiq
+
+import (
+	"encoding/json"
+
+	. "launchpad.net/gocheck"
+)
+
+type emailSender struct{ sent chan EmailArgs }
+
+func (s emailSender) Perform(args EmailArgs) error {
+	s.sent <- args
+	return nil
+}
+
+func (s *WorkerSuite) TestRegisterWorker(c *C) {
+	w := NewWorkerConfig()
+	sender := emailSender{make(chan EmailArgs, 1)}
+	MaybeFail(c, RegisterWorker[EmailArgs](w, "EmailJob", sender))
+	c.Assert(RegisterWorker[EmailArgs](w, "NilJob", nil), Equals, ErrNilWorker)
+
+	data := json.RawMessage(`[{"Address":"a@example.com","Count":1}]`)
+	w.process(&Job{Type: "EmailJob", Args: &data, Queue: "default", ID: "123"}, "test")
+	c.Assert(<-sender.sent, DeepEquals, EmailArgs{Address: "a@example.com", Count: 1})
+}
@@ -0,0 +1,54 @@
+package gokiq
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// CompletedJob is an entry in the history of completed jobs.
+type CompletedJob struct {
+	ID         string  `json:"jid"`
+	Type       string  `json:"class"`
+	Queue      string  `json:"queue"`
+	Duration   float64 `json:"duration"` // seconds
+	Success    bool    `json:"success"`
+	FinishedAt float64 `json:"finished_at"`
+}
+
+// queues the commands that add a job to the history on a connection in MULTI mode
+func (w *WorkerConfig) sendHistory(conn redis.Conn, job *Job, success bool) {
+	entry, _ := json.Marshal(&CompletedJob{
+		ID:         job.ID,
+		Type:       job.Type,
+		Queue:      job.Queue,
+		Duration:   time.Since(job.StartTime).Seconds(),
+		Success:    success,
+		FinishedAt: timeFloat(time.Now()),
+	})
+	ttl := w.HistoryTTL
+	if ttl <= 0 {
+		ttl = keyExpiry * time.Second
+	}
+
+	key := w.nsKey("history")
+	conn.Send("LPUSH", key, entry)
+	conn.Send("LTRIM", key, 0, w.HistorySize-1)
+	conn.Send("PEXPIRE", key, int64(ttl/time.Millisecond))
+}
+
+// History returns the most recently completed jobs, newest first.
+func (w *WorkerConfig) History() ([]CompletedJob, error) {
+	entries, err := redis.Values(w.redisQuery("LRANGE", w.nsKey("history"), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]CompletedJob, len(entries))
+	for i, entry := range entries {
+		if err := json.Unmarshal(entry.([]byte), &jobs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return jobs, nil
+}
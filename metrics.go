@@ -0,0 +1,143 @@
+package gokiq
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// adds a run to a bucket of a class's summary, which expires at ARGV[2]
+var classStatsScript = redis.NewScript(1, `
+redis.call("HINCRBY", KEYS[1], "count", 1)
+redis.call("HINCRBYFLOAT", KEYS[1], "total", ARGV[1])
+local max = tonumber(redis.call("HGET", KEYS[1], "max") or "0")
+if tonumber(ARGV[1]) > max then
+  redis.call("HSET", KEYS[1], "max", ARGV[1])
+end
+redis.call("PEXPIREAT", KEYS[1], ARGV[2])`)
+
+// the number of buckets a class's summary is kept in, so that runs drop out of
+// it a bucket at a time as they get older than ClassStatsTTL
+const classStatsBuckets = 24
+
+// ClassSummary is the runtime summary of a worker class, see TrackClassStats.
+type ClassSummary struct {
+	Count int
+	Total time.Duration
+	Max   time.Duration
+}
+
+// Mean returns the average runtime of the class's jobs.
+func (s ClassSummary) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Count)
+}
+
+// the window of the class summaries and the size of their buckets
+func (w *WorkerConfig) classStatsWindow() (time.Duration, time.Duration) {
+	ttl := w.ClassStatsTTL
+	if ttl <= 0 {
+		ttl = keyExpiry * time.Second
+	}
+	bucket := ttl / classStatsBuckets
+	if bucket < time.Millisecond {
+		bucket = time.Millisecond
+	}
+	return ttl, bucket
+}
+
+// the key of the bucket of a class's summary with the given index
+func (w *WorkerConfig) classStatsKey(class string, bucket int64) string {
+	return w.nsKey("stat:class:" + class + ":" + strconv.FormatInt(bucket, 10))
+}
+
+// queues the command that adds a finished job to its class's summary on a
+// connection in MULTI mode
+func (w *WorkerConfig) sendClassStats(conn redis.Conn, job *Job) {
+	ttl, size := w.classStatsWindow()
+	now := time.Now()
+	bucket := now.UnixNano() / int64(size)
+	expireAt := time.Unix(0, (bucket+1)*int64(size)).Add(ttl)
+	duration := strconv.FormatFloat(now.Sub(job.StartTime).Seconds(), 'f', -1, 64)
+	classStatsScript.Send(conn, w.classStatsKey(job.Type, bucket), duration, expireAt.UnixNano()/int64(time.Millisecond))
+}
+
+// ClassStats returns the runtime summary of the jobs of the named worker class
+// that finished within about the last ClassStatsTTL.
+func (w *WorkerConfig) ClassStats(class string) (ClassSummary, error) {
+	ttl, size := w.classStatsWindow()
+	last := time.Now().UnixNano() / int64(size)
+	first := time.Now().Add(-ttl).UnixNano() / int64(size)
+
+	conn := w.RedisPool.Get()
+	defer conn.Close()
+	for bucket := first; bucket <= last; bucket++ {
+		conn.Send("HGETALL", w.classStatsKey(class, bucket))
+	}
+	if err := conn.Flush(); err != nil {
+		return ClassSummary{}, err
+	}
+	var summary ClassSummary
+	var total, max float64
+	for bucket := first; bucket <= last; bucket++ {
+		fields, err := redis.StringMap(conn.Receive())
+		if err != nil {
+			return ClassSummary{}, err
+		}
+		count, _ := strconv.Atoi(fields["count"])
+		summary.Count += count
+		t, _ := strconv.ParseFloat(fields["total"], 64)
+		total += t
+		if m, _ := strconv.ParseFloat(fields["max"], 64); m > max {
+			max = m
+		}
+	}
+	summary.Total = time.Duration(total * float64(time.Second))
+	summary.Max = time.Duration(max * float64(time.Second))
+	return summary, nil
+}
+
+// LastError is the most recent error of a worker class, see TrackLastErrors.
+type LastError struct {
+	JID     string    `json:"jid"`
+	Type    string    `json:"error_class"`
+	Message string    `json:"error_message"`
+	Tags    []string  `json:"tags,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+func (w *WorkerConfig) recordLastError(job *Job, err error) {
+	data, _ := json.Marshal(LastError{
+		JID:     job.ID,
+		Type:    fmt.Sprintf("%T", err),
+		Message: err.Error(),
+		Tags:    job.Tags,
+		At:      time.Now().UTC(),
+	})
+	if _, err := w.redisQuery("HSET", w.nsKey("last_errors"), job.Type, data); err != nil {
+		w.handleError(err)
+	}
+}
+
+// LastErrors returns the most recent error of each worker class that has
+// failed, by class.
+func (w *WorkerConfig) LastErrors() (map[string]LastError, error) {
+	fields, err := redis.StringMap(w.redisQuery("HGETALL", w.nsKey("last_errors")))
+	if err != nil {
+		return nil, err
+	}
+	errs := make(map[string]LastError, len(fields))
+	for class, data := range fields {
+		var last LastError
+		if err := json.Unmarshal([]byte(data), &last); err != nil {
+			return nil, err
+		}
+		errs[class] = last
+	}
+	return errs, nil
+}
@@ -0,0 +1,59 @@
+package gokiq
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// ClientMiddleware wraps the push of each job by a client, like Sidekiq's
+// client middleware. It can change the payload, for example to add a tenant
+// or trace id or a default retry count, before calling next to push it, or
+// drop the job by returning without calling next. The payload's queue field
+// is the queue the job is pushed to. For QueueJobs and EnqueueBulk, next only
+// adds the job to the batch that is pushed afterwards.
+type ClientMiddleware func(payload map[string]interface{}, next func() error) error
+
+// Use adds middleware that wraps every job pushed by the client. Middleware
+// runs in the order it was added, so the first one added is the outermost.
+func (c *ClientConfig) Use(middleware ...ClientMiddleware) {
+	c.middleware = append(c.middleware, middleware...)
+}
+
+// runs the middleware around push
+func (c *ClientConfig) runMiddleware(payload map[string]interface{}, push func() error) error {
+	next := push
+	for i := len(c.middleware) - 1; i >= 0; i-- {
+		mw, inner := c.middleware[i], next
+		next = func() error { return mw(payload, inner) }
+	}
+	return next()
+}
+
+// the payload of a job as a map, for middleware
+func jobPayload(job *Job) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(job.JSON()))
+	dec.UseNumber() // so that large numbers in args are pushed unchanged
+	var payload map[string]interface{}
+	if err := dec.Decode(&payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// runs the middleware on a job that is pushed in bulk, setting data to its
+// marshaled payload unless a middleware drops it. It returns the queue the
+// job is pushed to.
+func (c *ClientConfig) stagePayload(job *Job, queue string, data *[]byte) (string, error) {
+	msg, err := jobPayload(job)
+	if err != nil {
+		return "", err
+	}
+	msg["queue"] = queue
+	err = c.runMiddleware(msg, func() error {
+		queue = fmt.Sprint(msg["queue"])
+		*data, err = json.Marshal(msg)
+		return err
+	})
+	return queue, err
+}
@@ -0,0 +1,125 @@
+package gokiq
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// WorkerOption changes a setting of a WorkerConfig made by NewWorkerConfig.
+// The options are applied before the default pools are made, so they are made
+// with the configured server and worker count.
+type WorkerOption func(*WorkerConfig)
+
+// WithRedisURL sets RedisServer, a host:port or redis:// URL.
+func WithRedisURL(server string) WorkerOption {
+	return func(w *WorkerConfig) { w.RedisServer = server }
+}
+
+// WithRedisPool sets RedisPool instead of making one for RedisServer.
+func WithRedisPool(pool *redis.Pool) WorkerOption {
+	return func(w *WorkerConfig) { w.RedisPool = pool }
+}
+
+// WithNamespace sets RedisNamespace.
+func WithNamespace(namespace string) WorkerOption {
+	return func(w *WorkerConfig) { w.RedisNamespace = namespace }
+}
+
+// WithQueues sets Queues.
+func WithQueues(queues QueueConfig) WorkerOption {
+	return func(w *WorkerConfig) { w.Queues = queues }
+}
+
+// WithQueuesFunc sets QueuesFunc.
+func WithQueuesFunc(queues func() QueueConfig) WorkerOption {
+	return func(w *WorkerConfig) { w.QueuesFunc = queues }
+}
+
+// WithWorkerCount sets WorkerCount.
+func WithWorkerCount(count int) WorkerOption {
+	return func(w *WorkerConfig) { w.WorkerCount = count }
+}
+
+// WithPollInterval sets PollInterval.
+func WithPollInterval(interval time.Duration) WorkerOption {
+	return func(w *WorkerConfig) { w.PollInterval = interval }
+}
+
+// WithStopTimeout sets StopTimeout.
+func WithStopTimeout(timeout time.Duration) WorkerOption {
+	return func(w *WorkerConfig) { w.StopTimeout = timeout }
+}
+
+// WithJobTimeout sets JobTimeout.
+func WithJobTimeout(timeout time.Duration) WorkerOption {
+	return func(w *WorkerConfig) { w.JobTimeout = timeout }
+}
+
+// WithJIDGenerator sets JIDGenerator.
+func WithJIDGenerator(generate func() string) WorkerOption {
+	return func(w *WorkerConfig) { w.JIDGenerator = generate }
+}
+
+// WithErrorReporter sets ReportError.
+func WithErrorReporter(report func(error, *Job)) WorkerOption {
+	return func(w *WorkerConfig) { w.ReportError = report }
+}
+
+// WithFetcher sets Fetcher.
+func WithFetcher(fetcher Fetcher) WorkerOption {
+	return func(w *WorkerConfig) { w.Fetcher = fetcher }
+}
+
+// EnqueueOption changes a setting of a job pushed with Push.
+type EnqueueOption func(*enqueueOptions)
+
+type enqueueOptions struct {
+	queue string
+	retry interface{}
+	jid   string
+	tags  []string
+	at    time.Time
+
+	expiresIn time.Duration
+	priority  int
+}
+
+// WithQueue pushes the job onto the named queue instead of "default".
+func WithQueue(queue string) EnqueueOption {
+	return func(o *enqueueOptions) { o.queue = queue }
+}
+
+// WithRetry sets the number of times the job is retried.
+func WithRetry(retries int) EnqueueOption {
+	return func(o *enqueueOptions) { o.retry = retries }
+}
+
+// WithJID sets the job's jid instead of generating one.
+func WithJID(jid string) EnqueueOption {
+	return func(o *enqueueOptions) { o.jid = jid }
+}
+
+// WithTags adds tags to the job, which are shown in Sidekiq's Web UI.
+func WithTags(tags ...string) EnqueueOption {
+	return func(o *enqueueOptions) { o.tags = append(o.tags, tags...) }
+}
+
+// WithExpiresIn drops the job instead of running it if a worker fetches it
+// later than d after it is queued, or after the time set by WithAt.
+func WithExpiresIn(d time.Duration) EnqueueOption {
+	return func(o *enqueueOptions) { o.expiresIn = d }
+}
+
+// WithPriority pushes the job into its queue's sorted set with a priority, so
+// that it runs ahead of jobs with a lower priority, if the client and workers
+// have the queue in SortedQueues. Elsewhere the job is pushed onto the queue
+// as usual. A priority of zero is the same as none.
+func WithPriority(priority int) EnqueueOption {
+	return func(o *enqueueOptions) { o.priority = priority }
+}
+
+// WithAt schedules the job to be queued at t, as with EnqueueAt.
+func WithAt(t time.Time) EnqueueOption {
+	return func(o *enqueueOptions) { o.at = t }
+}
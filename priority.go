@@ -0,0 +1,66 @@
+package gokiq
+
+import (
+	"time"
+)
+
+func (w *WorkerConfig) isPriority(queue string) bool {
+	for _, priority := range w.PriorityQueues {
+		if priority == queue {
+			return true
+		}
+	}
+	return false
+}
+
+// fetches jobs from PriorityQueues and dispatches them on priorityQueue until
+// Shutdown is called
+func (w *WorkerConfig) priorityFetcher() {
+	keys := make([]interface{}, len(w.PriorityQueues))
+	for i, queue := range w.PriorityQueues {
+		keys[i] = w.nsKey("queue:" + queue)
+	}
+	for w.ctx.Err() == nil {
+		w.runPriority(keys)
+	}
+}
+
+func (w *WorkerConfig) runPriority(keys []interface{}) {
+	w.RLock() // don't let Shutdown() close priorityQueue while we're sending on it
+	defer w.RUnlock()
+	if w.ctx.Err() != nil {
+		return
+	}
+
+	job, err := w.fetch(w.ctx, keys)
+	if err != nil {
+		w.handleError(err)
+		select {
+		case <-time.After(w.ErrorBackoff):
+		case <-w.ctx.Done():
+		}
+		return
+	}
+	if job == nil {
+		return
+	}
+	w.holdJob(job)
+	w.dispatch(job, w.priorityQueue)
+}
+
+// receives the next message for a worker goroutine, taking a priority job
+// over one from the other queues when both are waiting. It returns false once
+// Shutdown has closed the channels.
+func (w *WorkerConfig) nextMessage() (message, bool) {
+	select {
+	case msg, ok := <-w.priorityQueue:
+		return msg, ok
+	default:
+	}
+	select {
+	case msg, ok := <-w.priorityQueue:
+		return msg, ok
+	case msg, ok := <-w.workQueue:
+		return msg, ok
+	}
+}
@@ -0,0 +1,57 @@
+package gokiq
+
+import (
+	"time"
+)
+
+// finished jobs are counted in one bucket per second of the rate window
+type rateBucket struct {
+	second int64
+	count  int
+}
+
+func (w *WorkerConfig) rateWindow() time.Duration {
+	if w.RateWindow < time.Second {
+		return defaultRateWindow
+	}
+	return w.RateWindow
+}
+
+func (w *WorkerConfig) recordFinish(t time.Time) {
+	size := int(w.rateWindow() / time.Second)
+	second := t.Unix()
+
+	w.rateMtx.Lock()
+	if len(w.rateBuckets) != size {
+		w.rateBuckets = make([]rateBucket, size)
+	}
+	b := &w.rateBuckets[second%int64(size)]
+	if b.second < second {
+		b.second, b.count = second, 0
+	}
+	if b.second == second {
+		b.count++
+	}
+	w.rateMtx.Unlock()
+}
+
+func (w *WorkerConfig) rate(now time.Time) float64 {
+	window := w.rateWindow()
+	oldest := now.Unix() - int64(window/time.Second)
+
+	count := 0
+	w.rateMtx.Lock()
+	for _, b := range w.rateBuckets {
+		if b.second > oldest && b.second <= now.Unix() {
+			count += b.count
+		}
+	}
+	w.rateMtx.Unlock()
+	return float64(count) / window.Seconds()
+}
+
+// Rate returns the number of jobs per second that this process finished over
+// the last RateWindow.
+func (w *WorkerConfig) Rate() float64 {
+	return w.rate(time.Now())
+}
@@ -0,0 +1,122 @@
+package gokiq
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// pops the job with the lowest score off the first non-empty sorted set in
+// KEYS, and returns its key and payload
+var popSortedScript = redis.NewScript(-1, `
+for _, key in ipairs(KEYS) do
+	local jobs = redis.call('ZRANGE', key, 0, 0)
+	if #jobs > 0 then
+		redis.call('ZREM', key, jobs[1])
+		return {key, jobs[1]}
+	end
+end
+return false`)
+
+// the length of the prefix of a member of a sorted queue, which is the time it
+// was pushed in hex nanoseconds
+const sortedPrefixLen = 16
+
+// the score and member of a job in a sorted queue. The score is the negated
+// priority, so that the highest is popped first, and jobs with the same
+// priority are kept in the order pushed by the member's time prefix, since
+// Redis orders members with the same score by their bytes.
+func sortedEntry(priority int, at time.Time, data []byte) (int, []byte) {
+	return -priority, append([]byte(fmt.Sprintf("%016x", at.UnixNano())), data...)
+}
+
+// the time a payload was queued at, which orders it in a sorted queue
+func enqueuedTime(msg map[string]interface{}) time.Time {
+	if enqueued, ok := msg["enqueued_at"].(float64); ok && enqueued > 0 {
+		return floatTime(enqueued)
+	}
+	return time.Now()
+}
+
+// the key of the sorted set that holds the jobs of queue pushed with a priority
+func (c *ClientConfig) sortedKey(queue string) string {
+	return c.nsKey("sorted:" + queue)
+}
+
+func (c *ClientConfig) isSorted(queue string) bool {
+	for _, sorted := range c.SortedQueues {
+		if sorted == queue {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *WorkerConfig) sortedKey(queue string) string {
+	return w.nsKey("sorted:" + queue)
+}
+
+// puts a fetched job back at the front of its queue, or into its queue's
+// sorted set with the score and place it was pushed with if it came from one
+func (w *WorkerConfig) pushBack(job *Job) error {
+	if job.Priority != 0 && w.isSorted(job.Queue) {
+		score, member := sortedEntry(job.Priority, job.Enqueued(), job.JSON())
+		_, err := w.redisQuery("ZADD", w.sortedKey(job.Queue), score, member)
+		return err
+	}
+	_, err := w.redisQuery("LPUSH", w.nsKey("queue:"+job.Queue), job.JSON())
+	return err
+}
+
+func (w *WorkerConfig) isSorted(queue string) bool {
+	for _, sorted := range w.SortedQueues {
+		if sorted == queue {
+			return true
+		}
+	}
+	return false
+}
+
+// pops the job with the highest priority off the sorted sets of the sorted
+// queues among the namespaced queue keys, in their order. It returns a nil job
+// if they are all empty.
+func (w *WorkerConfig) popSorted(queues []interface{}) (*Job, error) {
+	keys := make([]interface{}, 1, len(queues)+1)
+	names := make(map[string]string, len(queues))
+	for _, key := range queues {
+		name := w.queueName(key.(string))
+		if w.isSorted(name) {
+			keys = append(keys, w.sortedKey(name))
+			names[w.sortedKey(name)] = name
+		}
+	}
+	if len(keys) == 1 {
+		return nil, nil
+	}
+	keys[0] = len(keys) - 1
+
+	conn := w.RedisPool.Get()
+	defer conn.Close()
+	res, err := redis.Values(popSortedScript.Do(conn, keys...))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := redis.String(res[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	member := res[1].([]byte)
+	if len(member) < sortedPrefixLen {
+		return nil, fmt.Errorf("gokiq: Invalid sorted queue entry %q", member)
+	}
+	job := &Job{}
+	if err := job.FromJSON(member[sortedPrefixLen:]); err != nil {
+		return nil, err
+	}
+	job.Queue = names[key]
+	return job, nil
+}
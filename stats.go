@@ -0,0 +1,67 @@
+package gokiq
+
+import (
+	"log"
+	"time"
+)
+
+// increments a stat counter, or adds it to the pending increments if
+// StatFlushInterval is set
+func (w *WorkerConfig) incrStat(key string) {
+	if w.StatFlushInterval > 0 {
+		w.addStat(key, 1)
+		return
+	}
+	if _, err := w.redisQuery("INCR", w.nsKey(key)); err != nil {
+		w.handleError(err)
+	}
+}
+
+func (w *WorkerConfig) addStat(key string, n int64) {
+	w.statsMtx.Lock()
+	if w.pendingStats == nil {
+		w.pendingStats = make(map[string]int64)
+	}
+	w.pendingStats[key] += n
+	w.statsMtx.Unlock()
+}
+
+// adds the pending increments to their counters in one transaction. They are
+// kept for the next flush if it fails.
+func (w *WorkerConfig) flushStats() {
+	w.statsMtx.Lock()
+	stats := w.pendingStats
+	w.pendingStats = nil
+	w.statsMtx.Unlock()
+	if len(stats) == 0 {
+		return
+	}
+
+	conn := w.RedisPool.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	for key, n := range stats {
+		conn.Send("INCRBY", w.nsKey(key), n)
+	}
+	if _, err := conn.Do("EXEC"); err != nil {
+		log.Printf(`event=stat_flush_error counters=%d error_message="%s" pid=%d`, len(stats), err, pid)
+		w.handleError(err)
+		for key, n := range stats {
+			w.addStat(key, n)
+		}
+	}
+}
+
+// flushes stats every StatFlushInterval until Shutdown, which does the last one
+func (w *WorkerConfig) statFlusher() {
+	ticker := time.NewTicker(w.StatFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.flushStats()
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package gokiq
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// StrictArgsError is returned by the enqueue methods of a client with
+// StrictArgs set for args that other Sidekiq apps can't read back as they
+// were given. Path is where the arg is, like args[1].User.
+type StrictArgsError struct {
+	Type   string
+	Path   string
+	Reason string
+}
+
+func (e StrictArgsError) Error() string {
+	return fmt.Sprintf("gokiq: Unsafe arg %s for %s: %s", e.Path, e.Type, e.Reason)
+}
+
+var (
+	typeOfJSONMarshaler = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	typeOfTextMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	typeOfRawMessage    = reflect.TypeOf(json.RawMessage{})
+	typeOfNumber        = reflect.TypeOf(json.Number(""))
+)
+
+// checks that args are made of JSON's own types only: nil, bools, numbers,
+// strings, and slices and string-keyed maps of them. Structs are allowed if
+// all of their fields are exported and safe, but not types that marshal
+// themselves, like time.Time, whose values would arrive as something else.
+func checkStrictArgs(class string, args interface{}) error {
+	if path, reason := strictArg(reflect.ValueOf(args), "args"); reason != "" {
+		return StrictArgsError{class, path, reason}
+	}
+	return nil
+}
+
+// returns the path and the reason for the first unsafe value in v
+func strictArg(v reflect.Value, path string) (string, string) {
+	if !v.IsValid() {
+		return "", ""
+	}
+	typ := v.Type()
+	if typ == typeOfRawMessage || typ == typeOfNumber {
+		return "", ""
+	}
+	if marshals(typ) {
+		return path, fmt.Sprintf("%s marshals itself", typ)
+	}
+
+	switch v.Kind() {
+	case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return "", ""
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return "", ""
+		}
+		return strictArg(v.Elem(), path)
+	case reflect.Slice, reflect.Array:
+		if typ.Elem().Kind() == reflect.Uint8 {
+			return "", "" // a base64 string, see ArgBytes
+		}
+		for i := 0; i < v.Len(); i++ {
+			if path, reason := strictArg(v.Index(i), fmt.Sprintf("%s[%d]", path, i)); reason != "" {
+				return path, reason
+			}
+		}
+		return "", ""
+	case reflect.Map:
+		if typ.Key().Kind() != reflect.String {
+			return path, fmt.Sprintf("%s has keys that aren't strings", typ)
+		}
+		for _, key := range v.MapKeys() {
+			if path, reason := strictArg(v.MapIndex(key), path+"."+key.String()); reason != "" {
+				return path, reason
+			}
+		}
+		return "", ""
+	case reflect.Struct:
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if field.PkgPath != "" {
+				return path, fmt.Sprintf("%s has unexported field %s", typ, field.Name)
+			}
+			if path, reason := strictArg(v.Field(i), path+"."+field.Name); reason != "" {
+				return path, reason
+			}
+		}
+		return "", ""
+	}
+	return path, fmt.Sprintf("%s can't be marshaled to JSON", typ)
+}
+
+// whether values of typ, or pointers to them, marshal themselves
+func marshals(typ reflect.Type) bool {
+	ptr := reflect.PtrTo(typ)
+	return typ.Implements(typeOfJSONMarshaler) || ptr.Implements(typeOfJSONMarshaler) ||
+		typ.Implements(typeOfTextMarshaler) || ptr.Implements(typeOfTextMarshaler)
+}
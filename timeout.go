@@ -0,0 +1,31 @@
+package gokiq
+
+import (
+	"fmt"
+	"time"
+)
+
+// JobTimeoutError is the error that a job is retried with when it returns
+// after its timeout has passed and its context has expired.
+type JobTimeoutError struct {
+	Type    string
+	Timeout time.Duration
+	Err     error // the error the job returned, or the context's if it was nil
+}
+
+func (e JobTimeoutError) Error() string {
+	return fmt.Sprintf("gokiq: Job of type %s timed out after %s: %s", e.Type, e.Timeout, e.Err)
+}
+
+func (e JobTimeoutError) Unwrap() error { return e.Err }
+
+// the timeout of the jobs of a worker class, from JobTimeouts or JobTimeout
+func (w *WorkerConfig) jobTimeout(class string) time.Duration {
+	if timeout, ok := w.JobTimeouts[class]; ok {
+		if timeout < 0 {
+			return 0
+		}
+		return timeout
+	}
+	return w.JobTimeout
+}
@@ -0,0 +1,115 @@
+package gokiq
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+
+// RegisterTyped registers a handler function for the named worker class
+// instead of a Worker type. The handler must be a func(T) error, and each
+// job's args are decoded into a T before it is called:
+//
+//   - args that are an object, or an array holding a single object when T is
+//     a struct or map, are unmarshaled into T
+//   - other arrays are unmarshaled into T if it is a slice or array, or else
+//     assigned to the exported fields of the T struct in order, as Sidekiq
+//     passes them to perform
+func (w *WorkerConfig) RegisterTyped(name string, handler interface{}) error {
+	fn := reflect.ValueOf(handler)
+	if fn.Kind() != reflect.Func || fn.IsNil() || fn.Type().NumIn() != 1 || fn.Type().NumOut() != 1 || fn.Type().Out(0) != typeOfError {
+		return fmt.Errorf("gokiq: Handler for %s isn't a func(T) error: %T", name, handler)
+	}
+	argType := fn.Type().In(0)
+	pool := &workerPool{resettable: true}
+	pool.New = func() interface{} {
+		return &typedWorker{handler: fn, argType: argType, useNumber: w.UseNumber}
+	}
+
+	w.mappingMtx.Lock()
+	w.workerMapping[name] = reflect.TypeOf(typedWorker{})
+	w.atMostOnce[name] = false
+	w.workerPools[name] = pool
+	w.mappingMtx.Unlock()
+	return nil
+}
+
+// performs jobs by calling a handler registered with RegisterTyped
+type typedWorker struct {
+	handler   reflect.Value
+	argType   reflect.Type
+	useNumber bool
+	args      []byte
+}
+
+// keeps the args to be decoded into the handler's type by Perform
+func (t *typedWorker) UnmarshalJSON(data []byte) error {
+	t.args = append(t.args[:0], data...)
+	return nil
+}
+
+func (t *typedWorker) Perform() error {
+	arg := reflect.New(t.argType)
+	if err := decodeTypedArgs(t.args, arg.Interface(), t.useNumber); err != nil {
+		return err
+	}
+	err, _ := t.handler.Call([]reflect.Value{arg.Elem()})[0].Interface().(error)
+	return err
+}
+
+func (t *typedWorker) Reset() {
+	t.args = t.args[:0]
+}
+
+func decodeTypedArgs(data []byte, v interface{}, useNumber bool) error {
+	data = bytes.TrimSpace(data)
+	target := reflect.ValueOf(v).Elem()
+	kind := target.Kind()
+	if len(data) == 0 || data[0] != '[' || kind == reflect.Slice || kind == reflect.Array || kind == reflect.Interface {
+		return unmarshalArg(data, v, useNumber)
+	}
+
+	var elems []json.RawMessage
+	if err := json.Unmarshal(data, &elems); err != nil {
+		return err
+	}
+	if len(elems) == 1 && (kind == reflect.Struct || kind == reflect.Map) {
+		if elem := bytes.TrimSpace(elems[0]); len(elem) > 0 && elem[0] == '{' {
+			return unmarshalArg(elem, v, useNumber)
+		}
+	}
+	if kind != reflect.Struct {
+		if len(elems) != 1 {
+			return fmt.Errorf("gokiq: Can't decode %d args into a %s", len(elems), target.Type())
+		}
+		return unmarshalArg(elems[0], v, useNumber)
+	}
+
+	// positional args fill the exported fields in order
+	field := 0
+	for _, elem := range elems {
+		for field < target.NumField() && target.Type().Field(field).PkgPath != "" {
+			field++
+		}
+		if field == target.NumField() {
+			return fmt.Errorf("gokiq: Too many args for a %s: %d", target.Type(), len(elems))
+		}
+		if err := unmarshalArg(elem, target.Field(field).Addr().Interface(), useNumber); err != nil {
+			return err
+		}
+		field++
+	}
+	return nil
+}
+
+func unmarshalArg(data []byte, v interface{}, useNumber bool) error {
+	if !useNumber {
+		return json.Unmarshal(data, v)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
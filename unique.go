@@ -0,0 +1,108 @@
+package gokiq
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// UniqueUntil is when the lock of a unique job is released, allowing another
+// job with the same class, queue and args to be enqueued.
+type UniqueUntil string
+
+const (
+	// UniqueUntilStarted releases the lock when a worker starts the job, so
+	// that there is at most one copy of it waiting to run.
+	UniqueUntilStarted UniqueUntil = "started"
+
+	// UniqueUntilFinished releases the lock when the job succeeds, or when
+	// it fails for good. It is held while the job is retried.
+	UniqueUntilFinished UniqueUntil = "finished"
+)
+
+type uniqueConfig struct {
+	until  UniqueUntil
+	window time.Duration
+}
+
+// releases a unique job's lock if it is still held by the job
+var unlockScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+  return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// Unique makes the jobs of a worker class unique: a job that is enqueued while
+// another with the same queue and args holds the lock is dropped with
+// ErrDuplicateJob. The lock is released as set by until, or after window if
+// the job never gets there. The window defaults to a day. The bulk paths,
+// EnqueueBulk and QueueJobs, and EnqueueFromFile neither check for duplicates
+// nor take the lock.
+func (c *ClientConfig) Unique(class string, until UniqueUntil, window time.Duration) {
+	if window <= 0 {
+		window = keyExpiry * time.Second
+	}
+	c.mtx.Lock()
+	if c.uniqueJobs == nil {
+		c.uniqueJobs = make(map[string]uniqueConfig)
+	}
+	c.uniqueJobs[class] = uniqueConfig{until, window}
+	c.mtx.Unlock()
+}
+
+// takes the lock of a job if its class is unique, setting its unique fields.
+// It returns ErrDuplicateJob if another job holds the lock.
+func (c *ClientConfig) lockUnique(job *Job, args []byte) error {
+	c.mtx.Lock()
+	config, ok := c.uniqueJobs[job.Type]
+	c.mtx.Unlock()
+	if !ok {
+		return nil
+	}
+
+	sum := sha1.Sum([]byte(job.Type + "\x00" + job.Queue + "\x00" + string(args)))
+	key := c.nsKey("unique:" + job.Type + ":" + hex.EncodeToString(sum[:]))
+	reply, err := c.redisQuery("SET", key, job.ID, "NX", "PX", int64(config.window/time.Millisecond))
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return ErrDuplicateJob
+	}
+	job.UniqueKey, job.UniqueUntil = key, config.until
+	return nil
+}
+
+// releases the lock of a job that couldn't be pushed
+func (c *ClientConfig) unlockUnique(job *Job) {
+	if job.UniqueKey == "" {
+		return
+	}
+	conn := c.getConn()
+	defer conn.Close()
+	unlockScript.Do(conn, job.UniqueKey, job.ID)
+}
+
+// releases the lock of a unique job if it has reached the point it is held
+// until
+func (w *WorkerConfig) unlockUnique(job *Job, until UniqueUntil) {
+	if job.UniqueKey == "" || job.UniqueUntil != until {
+		return
+	}
+	conn := w.RedisPool.Get()
+	defer conn.Close()
+	if _, err := unlockScript.Do(conn, job.UniqueKey, job.ID); err != nil {
+		log.Printf(`event=unique_unlock_error job_id=%s job_type=%s error_message="%s" pid=%d`, job.ID, job.Type, err, pid)
+		w.handleError(err)
+	}
+}
+
+// the args of a payload as they are marshaled into it
+func payloadArgs(msg map[string]interface{}) []byte {
+	args, _ := json.Marshal(msg["args"])
+	return args
+}
@@ -0,0 +1,72 @@
+package gokiq
+
+import (
+	"time"
+)
+
+// WindowSpec is a daily window of time that jobs are allowed to run in, such
+// as business hours. Start and End are offsets from midnight; if End isn't
+// after Start, the window ends on the next day.
+type WindowSpec struct {
+	Start time.Duration
+	End   time.Duration
+
+	Days     []time.Weekday // the days the window opens on, every day if empty
+	Location *time.Location // defaults to the location of the time passed to Next
+}
+
+// Next returns t if it is inside the window, or else the start of the next
+// window after it. It returns t if the window never opens.
+func (w WindowSpec) Next(t time.Time) time.Time {
+	loc := w.Location
+	if loc == nil {
+		loc = t.Location()
+	}
+	t = t.In(loc)
+
+	// start from yesterday in case its window runs past midnight
+	for i := -1; i <= 7; i++ {
+		day := time.Date(t.Year(), t.Month(), t.Day()+i, 0, 0, 0, 0, loc)
+		if !w.opensOn(day.Weekday()) {
+			continue
+		}
+		start, end := day.Add(w.Start), day.Add(w.End)
+		if w.End <= w.Start {
+			end = end.Add(24 * time.Hour)
+		}
+		if t.Before(start) {
+			return start
+		}
+		if t.Before(end) {
+			return t
+		}
+	}
+	return t
+}
+
+func (w WindowSpec) opensOn(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// EnqueueInWindow queues a job for the named worker class with args on the
+// default queue, right away if the current time is inside window, or else in
+// the schedule set for the start of the next window. It returns the job's jid.
+func (c *ClientConfig) EnqueueInWindow(window WindowSpec, class string, args ...interface{}) (string, error) {
+	if args == nil {
+		args = []interface{}{}
+	}
+	now := time.Now()
+	at := window.Next(now)
+	if !at.After(now) {
+		at = time.Time{}
+	}
+	return c.enqueuePayload("", map[string]interface{}{"class": class, "args": args}, at)
+}
@@ -1,7 +1,11 @@
 package gokiq
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math"
@@ -9,10 +13,11 @@ import (
 	"os"
 	"os/signal"
 	"reflect"
-	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -25,16 +30,103 @@ type Job struct {
 	Queue string           `json:"queue,omitempty"`
 	ID    string           `json:"jid"`
 
-	Retry interface{} `json:"retry"` // can be int (number of retries) or bool (true means default)
+	Retry      interface{} `json:"retry"`                 // can be int (number of retries) or bool (true means default)
+	RetryQueue string      `json:"retry_queue,omitempty"` // the queue retries are pushed to instead of Queue
+	Priority   int         `json:"priority,omitempty"`    // higher runs first in a sorted queue, see SortedQueues
+
+	// shown in Sidekiq's Web UI, and included in logs and error reports
+	Tags []string `json:"tags,omitempty"`
+
+	// float Unix times of when the job was first pushed, and when it was last
+	// put on a queue, which is left out while it is scheduled
+	CreatedAt  float64 `json:"created_at,omitempty"`
+	EnqueuedAt float64 `json:"enqueued_at,omitempty"`
+
+	// a job that is fetched after this float Unix time is dropped instead of
+	// run, and counted in stat:expired
+	ExpiresAt float64 `json:"expires_at,omitempty"`
 
 	MaxRetries   int    `json:"-"`
 	RetryCount   int    `json:"retry_count"`
 	ErrorMessage string `json:"error_message,omitempty"`
 	ErrorType    string `json:"error_class,omitempty"`
-	RetriedAt    string `json:"retried_at,omitempty"`
-	FailedAt     string `json:"failed_at,omitempty"`
+
+	// Backtrace can be true or a number of lines to keep the stack of the last
+	// failure in ErrorBacktrace, as Sidekiq does
+	Backtrace      interface{} `json:"backtrace,omitempty"`
+	ErrorBacktrace []string    `json:"error_backtrace,omitempty"`
+
+	RetriedAt string `json:"retried_at,omitempty"`
+	FailedAt  string `json:"failed_at,omitempty"`
+
+	// retried_at and failed_at as float Unix times, which newer versions of
+	// Sidekiq write instead of the strings above, see FloatTimestamps
+	RetriedAtFloat float64 `json:"-"`
+	FailedAtFloat  float64 `json:"-"`
+
+	// at-most-once jobs are never retried or requeued, so a failure or an
+	// unclean shutdown loses them instead of risking a second run
+	AtMostOnce bool `json:"at_most_once,omitempty"`
+
+	// the lock of a unique job, see ClientConfig.Unique
+	UniqueKey   string      `json:"unique_key,omitempty"`
+	UniqueUntil UniqueUntil `json:"unique_until,omitempty"`
 
 	StartTime time.Time `json:"-"`
+
+	raw           []byte // the payload the job was read from
+	correlationID string
+}
+
+// NewJob returns a job for the named worker class with a new jid, the default
+// queue, and the default number of retries. It panics if the args can't be
+// marshaled to JSON.
+func NewJob(class string, args ...interface{}) *Job {
+	if args == nil {
+		args = []interface{}{}
+	}
+	data, err := json.Marshal(args)
+	if err != nil {
+		panic(fmt.Errorf("gokiq: Invalid job args: %s", err))
+	}
+	raw := json.RawMessage(data)
+	now := timeFloat(time.Now())
+	return &Job{
+		Type:       class,
+		Args:       &raw,
+		Queue:      "default",
+		ID:         generateJobID(),
+		Retry:      true,
+		MaxRetries: defaultMaxRetries,
+		CreatedAt:  now,
+		EnqueuedAt: now,
+	}
+}
+
+// Created returns the time the job was first pushed, or the zero time if the
+// payload doesn't have it.
+func (job *Job) Created() time.Time {
+	return floatTime(job.CreatedAt)
+}
+
+// Enqueued returns the time the job was last put on a queue, or the zero time
+// if the payload doesn't have it.
+func (job *Job) Enqueued() time.Time {
+	return floatTime(job.EnqueuedAt)
+}
+
+// Latency returns how long the job waited on its queue before it was started,
+// or has been waiting so far if it hasn't been. It is zero if the payload
+// doesn't have enqueued_at.
+func (job *Job) Latency() time.Duration {
+	if job.EnqueuedAt == 0 {
+		return 0
+	}
+	end := job.StartTime
+	if end.IsZero() {
+		end = time.Now()
+	}
+	return end.Sub(job.Enqueued())
 }
 
 func (job *Job) FromJSON(data []byte) error {
@@ -42,6 +134,7 @@ func (job *Job) FromJSON(data []byte) error {
 	if err != nil {
 		return err
 	}
+	job.raw = data
 	if max, ok := job.Retry.(float64); ok {
 		job.MaxRetries = int(max)
 	} else if r, ok := job.Retry.(bool); ok && !r {
@@ -56,21 +149,89 @@ func (job *Job) JSON() []byte {
 	return res
 }
 
+// the JSON form of a Job, whose failed_at and retried_at can be either a
+// TimestampFormat string or a float Unix time
+type jobJSON struct {
+	*jobFields
+	RetriedAt interface{} `json:"retried_at,omitempty"`
+	FailedAt  interface{} `json:"failed_at,omitempty"`
+}
+
+type jobFields Job // without the JSON methods
+
+func (job Job) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jobJSON{
+		jobFields: (*jobFields)(&job),
+		RetriedAt: failureTime(job.RetriedAt, job.RetriedAtFloat),
+		FailedAt:  failureTime(job.FailedAt, job.FailedAtFloat),
+	})
+}
+
+func (job *Job) UnmarshalJSON(data []byte) error {
+	fields := jobJSON{jobFields: (*jobFields)(job)}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	job.RetriedAt, job.RetriedAtFloat = parseFailureTime(fields.RetriedAt)
+	job.FailedAt, job.FailedAtFloat = parseFailureTime(fields.FailedAt)
+	return nil
+}
+
+func failureTime(s string, f float64) interface{} {
+	if f != 0 {
+		return f
+	}
+	if s != "" {
+		return s
+	}
+	return nil
+}
+
+func parseFailureTime(t interface{}) (string, float64) {
+	switch t := t.(type) {
+	case string:
+		return t, 0
+	case float64:
+		return "", t
+	}
+	return "", 0
+}
+
+// reports whether the job has failed before, with either form of failed_at
+func (job *Job) hasFailed() bool {
+	return job.FailedAt != "" || job.FailedAtFloat != 0
+}
+
 type message struct {
 	job *Job
 	die bool
 }
 
 const (
-	TimestampFormat     = "2006-01-02 15:04:05 MST"
-	dateFormat          = "2006-01-02"
-	redisTimeout        = 1
-	defaultMaxRetries   = 25
-	defaultPollInterval = 5 * time.Second
-	defaultStopTimeout  = 8 * time.Second
-	defaultWorkerCount  = 25
-	defaultRedisServer  = "127.0.0.1:6379"
-	keyExpiry           = 86400 // one day
+	TimestampFormat         = "2006-01-02 15:04:05 MST"
+	dateFormat              = "2006-01-02"
+	redisTimeout            = 1
+	defaultMaxRetries       = 25
+	defaultPollInterval     = 5 * time.Second
+	defaultStopTimeout      = 8 * time.Second
+	defaultWorkerCount      = 25
+	defaultIdleCheck        = time.Minute
+	defaultRedisServer      = "127.0.0.1:6379"
+	keyExpiry               = 86400 // one day
+	maxDeadJobs             = 10000
+	maxFetchBackoff         = time.Minute
+	defaultRateWindow       = time.Minute
+	trackAttempts           = 3 // for the transactions that track running jobs
+	waitEmptyInterval       = 100 * time.Millisecond
+	defaultClientPoolSize   = 10
+	defaultBulkBatchSize    = 1000
+	defaultShutdownProgress = 2 * time.Second
+	defaultCancelGrace      = time.Second
+	defaultBreakerCooldown  = time.Minute
+	defaultBacktraceLines   = 20
+	defaultRejectDelay      = 30 * time.Second
+	oomAttempts             = 3 // for writes that Redis refuses because it is out of memory
+	oomBackoff              = 100 * time.Millisecond
 )
 
 type QueueConfig map[string]int
@@ -80,9 +241,51 @@ func (q QueueConfig) String() string {
 	for queue, priority := range q {
 		str += fmt.Sprintf("%s=%d,", queue, priority)
 	}
-	return str[:len(str)-1]
+	return strings.TrimSuffix(str, ",")
+}
+
+// ParseQueues parses queues given in the syntax of Sidekiq's -q option, as a
+// list of queue names separated by spaces, each optionally followed by a comma
+// and its weight, like "critical,5 default". Queues without a weight get a
+// weight of one.
+func ParseQueues(spec string) (QueueConfig, error) {
+	queues := make(QueueConfig)
+	for _, field := range strings.Fields(spec) {
+		name, weight := field, 1
+		if i := strings.Index(field, ","); i >= 0 {
+			var err error
+			name = field[:i]
+			if weight, err = strconv.Atoi(field[i+1:]); err != nil || weight < 0 {
+				return nil, fmt.Errorf("gokiq: Invalid weight for queue %q: %q", name, field[i+1:])
+			}
+		}
+		if name == "" {
+			return nil, fmt.Errorf("gokiq: Missing queue name in %q", field)
+		}
+		queues[name] = weight
+	}
+	return queues, nil
 }
 
+// Worker is implemented by job types. Each job is performed by a new instance
+// of the registered type with the job's args unmarshaled into it. If the type
+// is a struct, an exported *Job field is set to the job being performed and an
+// exported context.Context field to a context that expires after the job's
+// timeout (see JobTimeouts) and is cancelled if it's still running when
+// Shutdown's StopTimeout runs out. A job that returns the context's error then
+// is put back on its queue instead of being retried. Workers that take the
+// context and a list of args in Perform instead are ContextWorkers.
+//
+// Args are encoded with encoding/json, so []byte fields are sent as base64
+// strings by the client and decoded back into the original bytes for the
+// worker. Binary data in an interface{} field arrives as the base64 string;
+// ArgBytes decodes it.
+//
+// Workers are registered with a value of their type or a pointer to one, and
+// both register the same type. Perform may have a value or a pointer receiver,
+// as it is always called on a pointer to a new instance. Register returns an
+// InvalidWorkerError for types that can't be used this way, such as pointers
+// to pointers.
 type Worker interface {
 	Perform() error
 }
@@ -91,171 +294,843 @@ type ReportableErrorChecker interface {
 	ReportableError(error) bool
 }
 
+// AtMostOnceWorker can be implemented by workers whose jobs must never be
+// performed more than once. The result of AtMostOnce is checked on the zero
+// value of the worker when it is registered.
+type AtMostOnceWorker interface {
+	AtMostOnce() bool
+}
+
+// ResettableWorker can be implemented by workers to clear their state before
+// they are reused when ReuseWorkers is set. Workers without it are zeroed, as
+// are workers whose Reset has a value receiver, since it can't clear anything.
+type ResettableWorker interface {
+	Reset()
+}
+
 var Workers = NewWorkerConfig()
 
 type WorkerConfig struct {
-	RedisPool      *redis.Pool
-	RedisNamespace string
-	Queues         QueueConfig
-	WorkerCount    int
-	PollInterval   time.Duration
-	StopTimeout    time.Duration
-	ReportError    func(error, *Job)
+	RedisPool                *redis.Pool
+	SchedulerPool            *redis.Pool // used by the scheduler so it never waits on workers for a connection
+	RedisServer              string      // host:port or redis:// URL dialed by the default pools, 127.0.0.1:6379 if empty
+	RedisNamespace           string
+	Queues                   QueueConfig
+	QueuesFunc               func() QueueConfig // replaces Queues when Run is called if set, e.g. with queues parsed from the environment
+	WorkerCount              int
+	PollInterval             time.Duration
+	StopTimeout              time.Duration
+	ShutdownProgressInterval time.Duration // how often Shutdown logs the number of jobs still running, 2s if zero
+	CancelGrace              time.Duration // how long Shutdown waits for jobs to stop once it cancels them at StopTimeout, 1s if zero
+	JobTimeout               time.Duration // deadline of the context passed to each job, none if zero; see JobTimeouts for the errors of jobs that pass it
+	WorkerMaxJobs            int           // worker goroutines are replaced after this many jobs, never if zero
+	IdleCheck                time.Duration // pooled connections idle for longer than this are PINGed before use, never if zero
+	FetchTimeout             time.Duration // how long a fetch blocks waiting for a job, rounded up to whole seconds; Shutdown stops it within a second
+	ErrorBackoff             time.Duration // sleep after a fetch error, doubled for each consecutive error
+	ReportError              func(error, *Job)
+	Fetcher                  Fetcher // defaults to WeightedFetcher
+
+	// OnFetch is called with every fetched job before it is dispatched to a
+	// worker. Returning an error rejects the job, which is put in the schedule
+	// set to be queued again after RejectDelay (30 seconds if zero), or into
+	// the dead set if DeadRejected is set.
+	OnFetch      func(*Job) error
+	DeadRejected bool
+	RejectDelay  time.Duration
+
+	// StrictRegistration sends jobs for unregistered worker types straight to
+	// the dead set instead of retrying them.
+	StrictRegistration bool
+
+	// SkipInvalidQueues stops fetching from queues whose key holds something
+	// other than a list, instead of failing every fetch that includes them.
+	SkipInvalidQueues bool
+
+	// OrderedQueues are queues whose jobs are performed one at a time, in the
+	// order they were queued. This is only enforced within a process, so they
+	// should be fetched by a single process, and a job that fails goes to the
+	// retry set and loses its place.
+	OrderedQueues []string
+
+	// PriorityQueues are fetched on their own, outside of Queues, and their
+	// jobs are handed to the next free worker ahead of the job that is
+	// waiting for one from the other queues. This puts whole queues ahead of
+	// the others; job priorities within a queue are SortedQueues.
+	PriorityQueues []string
+
+	// JobTimeouts overrides JobTimeout for the jobs of the worker classes it
+	// has, where a negative timeout means none. The timeout sets the deadline
+	// of the job's context, and a job that is still running when it passes
+	// is retried with a JobTimeoutError, whatever it returns. A job that
+	// ignores its context keeps its worker goroutine until it returns.
+	JobTimeouts map[string]time.Duration
+
+	// SortedQueues are queues in Queues or PriorityQueues whose jobs pushed
+	// with a priority (see WithPriority and the client's SortedQueues) are
+	// kept in a sorted set, and fetched ahead of the queue's other jobs from
+	// the highest priority to the lowest. Unlike PriorityQueues, this orders
+	// the jobs within a queue, not the queues.
+	// The sorted set is checked before each blocking fetch, so a job pushed
+	// while the worker is waiting on the queues can wait for up to
+	// FetchTimeout.
+	SortedQueues []string
+
+	// WorkerIDFunc returns the id of the worker goroutine with the given
+	// index, which names its entries in the workers set. The ids must be
+	// unique across the processes sharing a namespace. Defaults to
+	// hostname:pid-index.
+	WorkerIDFunc func(index int) string
+
+	// BackupFile is the path of a file that jobs still running at the end of
+	// StopTimeout are appended to, as JSON lines, if they can't be requeued.
+	// EnqueueFromFile pushes them back onto their queues.
+	BackupFile string
+
+	// RetrySets maps worker classes to the keys of retry sets that their
+	// retries are kept in instead of the shared one, so that they can be
+	// monitored separately. The scheduler promotes from all of them.
+	RetrySets map[string]string
+
+	// RetryFront pushes retries to the front of their queue when they are
+	// promoted, so they run before jobs that were queued in the meantime.
+	RetryFront bool
+
+	// ReuseWorkers keeps performed worker values in a pool and reuses them for
+	// later jobs of the same type instead of allocating one per job, which
+	// helps with large worker structs. Workers must not hold on to themselves
+	// after Perform returns.
+	ReuseWorkers bool
+
+	// ConcurrentPromotion promotes due jobs from the retry and schedule sets
+	// in parallel on separate connections, so that a large backlog in one
+	// doesn't hold up the other.
+	ConcurrentPromotion bool
+
+	// RetryWarnThreshold makes the scheduler log a warning and call
+	// OnRetryBacklog with the size of the retry set on every poll while the
+	// set holds more than this many jobs. There is no warning if it is zero.
+	RetryWarnThreshold int
+	OnRetryBacklog     func(size int)
+
+	// IsolatePerform runs each job on a new goroutine, so that its stack and
+	// anything tied to the goroutine is discarded once it finishes, at the
+	// cost of starting a goroutine per job.
+	IsolatePerform bool
+
+	// UseNumber decodes numbers in job args into interface{} fields as
+	// json.Number instead of float64, so that integers above 2^53 keep their
+	// precision. See ArgInt64.
+	UseNumber bool
+
+	// OnBeforeRetry is called with a failed job and its error before it is
+	// added to the retry set, and returns the job to add, which may carry
+	// context forward to the next attempt. A nil result adds the job as is.
+	OnBeforeRetry func(*Job, error) *Job
+
+	// DrainShortestFirst makes DrainQueues drain the queue with the fewest
+	// jobs next instead of the one with the highest weight.
+	DrainShortestFirst bool
+
+	// DrainOnShutdown makes Shutdown drain the queues with DrainQueues once
+	// the running jobs have finished, until StopTimeout runs out, so that a
+	// deploy leaves fewer jobs behind. With DrainShortestFirst, it finishes
+	// as many queues as it can.
+	DrainOnShutdown bool
+
+	// FloatTimestamps writes failed_at and retried_at as float Unix times, as
+	// newer versions of Sidekiq do, instead of TimestampFormat strings.
+	FloatTimestamps bool
+
+	// CorrelationField names a payload field with an id that is added to the
+	// job's log lines, to trace it across services. The jid is used if the
+	// field isn't set or the job doesn't have it.
+	CorrelationField string
+
+	// ErrorLogSample limits the job_error log lines for a job that keeps
+	// failing to its first failure, its last failure before it runs out of
+	// retries, and every ErrorLogSample-th retry in between. Every failure is
+	// logged if it is zero.
+	ErrorLogSample int
+
+	// JIDGenerator makes jids for jobs that were pushed without one, which
+	// the worker fills in before running them. See ClientConfig.JIDGenerator.
+	JIDGenerator func() string
+
+	// BacktraceLines is the most lines of error_backtrace kept in the retry
+	// payload of a job with backtrace set to true. It defaults to 20. A job
+	// can set backtrace to a number of lines instead.
+	BacktraceLines int
+
+	// HistorySize is the number of completed jobs kept in the history list,
+	// which expires HistoryTTL after the last job completes. No history is
+	// kept if it is zero.
+	HistorySize int
+	HistoryTTL  time.Duration
+
+	// TrackClassStats keeps a summary of the runtime of each worker class in
+	// Redis, see ClassStats. It covers the jobs that finished within the last
+	// ClassStatsTTL, a day if it is zero, which are kept in buckets of a 24th
+	// of it that drop out of the summary as they expire.
+	TrackClassStats bool
+	ClassStatsTTL   time.Duration
+
+	// StatFlushInterval batches the increments of the stat counters in
+	// memory and adds them to Redis this often and on Shutdown, instead of
+	// sending an INCR for every job. Increments that haven't been flushed are
+	// lost if the process crashes. Stats are sent right away if it is zero.
+	StatFlushInterval time.Duration
+
+	// TrackLastErrors keeps the most recent error of each worker class in a
+	// Redis hash, see LastErrors.
+	TrackLastErrors bool
+
+	// RateWindow is the period that Rate is computed over, in whole seconds.
+	// It defaults to a minute.
+	RateWindow time.Duration
+
+	// EventStream is the key of a Redis stream that job lifecycle events are
+	// added to. Events aren't emitted if it is empty.
+	EventStream string
+
+	// OnFetchErrors is called every MaxFetchErrors consecutive errors fetching
+	// jobs with the last error and the number of errors so far, so that a
+	// persistent problem can be escalated.
+	MaxFetchErrors int
+	OnFetchErrors  func(err error, count int)
+
+	// BreakerThreshold is the number of consecutive failures of a worker
+	// class, within BreakerWindow if it is set, that open its circuit
+	// breaker. While a breaker is open, the class's jobs are put in the
+	// schedule set to run BreakerCooldown later instead of being performed.
+	// After the cooldown one job is let through, which closes the breaker if
+	// it succeeds and opens it again if it fails. Breakers are disabled if
+	// the threshold is zero.
+	BreakerThreshold int
+	BreakerWindow    time.Duration
+	BreakerCooldown  time.Duration // a minute if zero
+
+	fetchErrors     int   // consecutive fetch errors, only used by the Run goroutine
+	ticking         int32 // set while the scheduler is polling, accessed atomically
+	schedulerPaused int32 // set by PauseScheduler, accessed atomically
+	inFlight        int32 // jobs fetched by Run that haven't finished, accessed atomically
+
+	reporters   []func(error, *Job)
+	reporterMtx sync.RWMutex
+
+	subscribers   []subscriber
+	subscriberMtx sync.RWMutex
 
 	// worker id -> job mapping
 	work    map[string]*Job
 	workMtx sync.Mutex
 
+	rateBuckets []rateBucket
+	rateMtx     sync.Mutex
+
+	breakers   map[string]*breaker
+	breakerMtx sync.Mutex
+
+	pendingStats map[string]int64 // increments waiting for flushStats, by un-namespaced key
+	statsMtx     sync.Mutex
+
+	skippedQueues map[string]bool
+	busyQueues    map[string]bool // ordered queues with a job in progress
+	orderedFree   chan struct{}
+	boosts        map[string]*queueBoost
+	queueMtx      sync.RWMutex
+
 	workerMapping map[string]reflect.Type
+	atMostOnce    map[string]bool
+	workerPools   map[string]*workerPool
+	validators    map[string]func(json.RawMessage) error
+	mappingMtx    sync.RWMutex // workers can be registered while Run is processing jobs
 	randomQueues  []string
 	workQueue     chan message
+	priorityQueue chan message // nil unless there are PriorityQueues
+	ready         chan struct{}
 	done          sync.WaitGroup
-	sync.RWMutex  // R is locked by Run() and scheduler(), W is locked by quitHandler() when it receives a signal
+	sync.RWMutex  // R is locked by Run() and scheduler(), W is locked by Shutdown()
+
+	// ctx is cancelled when Shutdown is called, stopped is closed when it returns
+	ctx      context.Context
+	cancel   context.CancelFunc
+	jobCtx   context.Context // the parent of job contexts, cancelled after StopTimeout
+	stopJobs context.CancelFunc
+	stopOnce sync.Once
+	stopped  chan struct{}
 }
 
-func NewWorkerConfig() *WorkerConfig {
+// NewWorkerConfig returns a config with the defaults, changed by any options.
+func NewWorkerConfig(opts ...WorkerOption) *WorkerConfig {
 	w := &WorkerConfig{
 		PollInterval:  defaultPollInterval,
 		StopTimeout:   defaultStopTimeout,
+		IdleCheck:     defaultIdleCheck,
+		FetchTimeout:  redisTimeout * time.Second,
+		ErrorBackoff:  redisTimeout * time.Second,
 		WorkerCount:   defaultWorkerCount,
 		Queues:        QueueConfig{"default": 1},
 		ReportError:   func(error, *Job) {},
 		workerMapping: make(map[string]reflect.Type),
+		atMostOnce:    make(map[string]bool),
+		workerPools:   make(map[string]*workerPool),
+		validators:    make(map[string]func(json.RawMessage) error),
 		workQueue:     make(chan message),
+		ready:         make(chan struct{}),
+		orderedFree:   make(chan struct{}, 1),
+		stopped:       make(chan struct{}),
 		work:          make(map[string]*Job),
 	}
-	w.RedisPool = redis.NewPool(func() (redis.Conn, error) {
-		return redis.Dial("tcp", defaultRedisServer)
-	}, w.WorkerCount+1)
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	w.jobCtx, w.stopJobs = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(w)
+	}
+	if w.Fetcher == nil {
+		w.Fetcher = WeightedFetcher(w)
+	}
+	if w.RedisPool == nil {
+		w.RedisPool = redis.NewPool(w.dial, w.WorkerCount+1)
+		w.RedisPool.TestOnBorrow = w.testOnBorrow
+	}
+	if w.SchedulerPool == nil {
+		w.SchedulerPool = w.newSchedulerPool()
+	}
 	return w
 }
 
-func Register(worker Worker, queue string, retries int) {
+// the scheduler only ever needs one connection, made the same way as the ones in RedisPool
+func (w *WorkerConfig) newSchedulerPool() *redis.Pool {
+	return &redis.Pool{
+		Dial:         func() (redis.Conn, error) { return w.RedisPool.Dial() },
+		TestOnBorrow: w.testOnBorrow,
+		MaxIdle:      1,
+	}
+}
+
+func Register(worker Worker, queue string, retries int) error {
+	if err := Workers.Register(worker); err != nil {
+		return err
+	}
+	if queue == "" {
+		queue = defaultQueue(worker)
+	}
 	Client.Register(worker, queue, retries)
-	Workers.Register(worker)
 	Workers.Queues[queue] = 1
+	return nil
 }
 
-func (w *WorkerConfig) Register(worker Worker) {
+func (w *WorkerConfig) Register(worker Worker) error {
+	if isNilWorker(worker) {
+		return ErrNilWorker
+	}
 	t := workerType(worker)
-	w.workerMapping[t.Name()] = t
+	return w.registerType(t.Name(), t)
 }
 
-func (w *WorkerConfig) RegisterName(name string, worker Worker) {
-	w.workerMapping[name] = workerType(worker)
+// RegisterValidator sets a function that checks the args of jobs of a worker
+// class before they are performed, to catch producers that have drifted from
+// the worker's contract. Jobs whose args it rejects are reported and moved to
+// the dead set with an InvalidArgsError, since retrying them can't help.
+func (w *WorkerConfig) RegisterValidator(class string, validate func(args json.RawMessage) error) {
+	w.mappingMtx.Lock()
+	w.validators[class] = validate
+	w.mappingMtx.Unlock()
 }
 
-func (w *WorkerConfig) Run() {
-	log.Printf("state=starting worker_count=%d queues=%q pid=%d", w.WorkerCount, w.Queues, pid)
-	w.denormalizeQueues()
+// AddErrorReporter adds a function that is called alongside ReportError for
+// every reported error.
+func (w *WorkerConfig) AddErrorReporter(reporter func(error, *Job)) {
+	w.reporterMtx.Lock()
+	w.reporters = append(w.reporters, reporter)
+	w.reporterMtx.Unlock()
+}
+
+func (w *WorkerConfig) RegisterName(name string, worker Worker) error {
+	if isNilWorker(worker) {
+		return ErrNilWorker
+	}
+	return w.registerType(name, workerType(worker))
+}
 
-	for i := 0; i < w.WorkerCount; i++ {
-		go w.worker(workerID(i))
+// workers are instantiated with reflect.New, so a pointer to the registered
+// type has to implement Worker
+func (w *WorkerConfig) registerType(name string, t reflect.Type) error {
+	if !reflect.PtrTo(t).Implements(typeOfWorker) {
+		return InvalidWorkerError{t.String()}
 	}
-	w.done.Add(w.WorkerCount)
+	atMostOnce := false
+	if worker, ok := reflect.New(t).Interface().(AtMostOnceWorker); ok {
+		atMostOnce = worker.AtMostOnce()
+	}
+
+	w.mappingMtx.Lock()
+	w.workerMapping[name] = t
+	w.atMostOnce[name] = atMostOnce
+	w.workerPools[name] = newWorkerPool(t)
+	w.mappingMtx.Unlock()
+	return nil
+}
 
-	go w.scheduler()
+// Run processes jobs until Shutdown is called or the process receives a
+// signal to stop. It only returns an error if the configuration is invalid.
+func (w *WorkerConfig) Run() error {
+	return w.start(true, true)
+}
+
+// RunWorkers is like Run, but without the scheduler that moves due jobs from
+// the retry and schedule sets onto their queues, which is left to a separate
+// process that calls RunScheduler with the same RedisNamespace. This way
+// workers can be scaled without adding schedulers that poll Redis.
+func (w *WorkerConfig) RunWorkers() error {
+	return w.start(true, false)
+}
+
+// RunScheduler runs the scheduler without fetching any jobs, for a process
+// that promotes jobs for others that call RunWorkers. Queues and WorkerCount
+// aren't used.
+func (w *WorkerConfig) RunScheduler() error {
+	return w.start(false, true)
+}
+
+func (w *WorkerConfig) start(workers, scheduler bool) error {
+	w.setDefaults()
+	workerCount := 0
+	if workers {
+		if w.QueuesFunc != nil {
+			w.Queues = w.QueuesFunc()
+		}
+		workerCount = w.WorkerCount
+	}
+	log.Printf("state=starting worker_count=%d queues=%q scheduler=%t pid=%d", workerCount, w.Queues, scheduler, pid)
+	// with only PriorityQueues to work, they are all fetched by priorityFetcher
+	onlyPriority := false
+	if workers {
+		w.denormalizeQueues()
+		if len(w.randomQueues) == 0 && len(w.PriorityQueues) == 0 {
+			return ErrNoQueues
+		}
+		onlyPriority = len(w.randomQueues) == 0
+	}
+
+	// handle signals right away so that one arriving during startup still stops cleanly
 	go w.quitHandler()
+	w.connectRedis()
+
+	// Shutdown can't close the work queue until the workers are started and
+	// counted, and nothing is started once it has been called
+	w.RLock()
+	if w.ctx.Err() == nil {
+		if workerCount > 0 && len(w.PriorityQueues) > 0 {
+			w.priorityQueue = make(chan message)
+			go w.priorityFetcher()
+		}
+		w.done.Add(workerCount)
+		for i := 0; i < workerCount; i++ {
+			go w.worker(w.workerID(i))
+		}
+		if scheduler {
+			go w.scheduler()
+		}
+		if w.StatFlushInterval > 0 {
+			go w.statFlusher()
+		}
 
-	log.Printf(`state=started pid=%d`, pid)
-	for {
+		close(w.ready)
+		log.Printf(`state=started pid=%d`, pid)
+	}
+	w.RUnlock()
+
+	for workers && !onlyPriority && w.ctx.Err() == nil {
 		w.run()
 	}
+	<-w.stopped
+	return nil
 }
 
 func (w *WorkerConfig) run() {
-	w.RLock() // don't let quitHandler() stop us in the middle of a job
+	w.RLock() // don't let Shutdown() stop us in the middle of a job
 	defer w.RUnlock()
-
-	msg, err := redis.Values(w.redisQuery("BLPOP", append(w.queueList(), redisTimeout)...))
-	if err == redis.ErrNil {
+	if w.ctx.Err() != nil {
 		return
 	}
+
+	job, err := w.Fetcher.Fetch(w.ctx)
 	if err != nil {
-		w.handleError(err)
-		time.Sleep(redisTimeout * time.Second) // likely a transient redis error, sleep before retrying
+		w.handleFetchError(err)
 		return
 	}
-
-	job := &Job{}
-	err = job.FromJSON(msg[1].([]byte))
-	if err != nil {
-		w.handleError(err)
+	w.fetchErrors = 0
+	if job == nil {
 		return
 	}
-	job.Queue = string(msg[0].([]byte)[len(w.nsKey("queue:")):])
-	w.workQueue <- message{job: job}
+	w.holdJob(job)
+
+	w.dispatch(job, w.workQueue)
 }
 
-// create a slice of queues with duplicates using the assigned frequencies
-func (w *WorkerConfig) denormalizeQueues() {
-	for queue, x := range w.Queues {
-		for i := 0; i < x; i++ {
-			w.randomQueues = append(w.randomQueues, w.nsKey("queue:"+queue))
+// hands a fetched job to a worker through queue, unless OnFetch rejects it
+func (w *WorkerConfig) dispatch(job *Job, queue chan<- message) {
+	if w.OnFetch != nil {
+		if err := w.OnFetch(job); err != nil {
+			w.rejectJob(job, err)
+			w.releaseJob(job)
+			return
 		}
 	}
+
+	select {
+	case queue <- message{job: job}:
+	case <-w.ctx.Done():
+		// all workers are busy and we're shutting down, put the job back at the front of its queue
+		err := w.pushBack(job)
+		w.releaseJob(job)
+		log.Printf("event=job_requeue job_id=%s job_type=%s queue=%s success=%t pid=%d", job.ID, job.Type, job.Queue, err == nil, pid)
+	}
+}
+
+// a fetched job keeps its queue busy if it is ordered, and counts as in flight
+// for WaitEmpty, until it has been performed or put back
+func (w *WorkerConfig) holdJob(job *Job) {
+	w.setQueueBusy(job.Queue, true)
+	atomic.AddInt32(&w.inFlight, 1)
+}
+
+func (w *WorkerConfig) releaseJob(job *Job) {
+	w.setQueueBusy(job.Queue, false)
+	atomic.AddInt32(&w.inFlight, -1)
+}
+
+// likely a transient redis error, back off before retrying, for longer the
+// more errors there have been in a row
+func (w *WorkerConfig) handleFetchError(err error) {
+	w.handleError(err)
+	w.fetchErrors++
+	if w.MaxFetchErrors > 0 && w.fetchErrors%w.MaxFetchErrors == 0 && w.OnFetchErrors != nil {
+		w.OnFetchErrors(err, w.fetchErrors)
+	}
+
+	delay := w.fetchBackoff()
+	log.Printf("event=fetch_backoff errors=%d delay=%s pid=%d", w.fetchErrors, delay, pid)
+	select {
+	case <-time.After(delay):
+	case <-w.ctx.Done():
+	}
+}
+
+func (w *WorkerConfig) fetchBackoff() time.Duration {
+	delay := w.ErrorBackoff
+	for i := 1; i < w.fetchErrors && delay < maxFetchBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxFetchBackoff {
+		delay = maxFetchBackoff
+	}
+	return delay
+}
+
+func (w *WorkerConfig) rejectJob(job *Job, err error) {
+	log.Printf("event=job_rejected job_id=%s job_type=%s queue=%s dead=%t error_type=%T error_message=%q pid=%d", job.ID, job.Type, job.Queue, w.DeadRejected, err, err, pid)
+	if w.DeadRejected {
+		w.killJob(job, err)
+		return
+	}
+	// scheduled instead of pushed straight back, so that a hook that keeps
+	// rejecting it doesn't keep fetching it
+	delay := w.RejectDelay
+	if delay <= 0 {
+		delay = defaultRejectDelay
+	}
+	at := strconv.FormatFloat(timeFloat(time.Now().Add(delay)), 'f', -1, 64)
+	if _, err := w.redisQuery("ZADD", w.nsKey("schedule"), at, job.JSON()); err != nil {
+		w.handleError(err)
+	}
 }
 
-// get a random slice of unique queues from the slice of denormalized queues
-func (w *WorkerConfig) queueList() []interface{} {
-	size := len(w.Queues)
-	res := make([]interface{}, 0, size)
-	queues := make(map[string]struct{}, size)
+// Ready returns a channel that is closed once Run has connected to Redis and
+// started all of its goroutines.
+func (w *WorkerConfig) Ready() <-chan struct{} {
+	return w.ready
+}
 
-	indices := rand.Perm(len(w.randomQueues))[:size]
-	for _, i := range indices {
-		queue := w.randomQueues[i]
-		if _, ok := queues[queue]; !ok {
-			queues[queue] = struct{}{}
-			res = append(res, queue)
+// blocks until Redis answers a PING or Shutdown is called
+func (w *WorkerConfig) connectRedis() {
+	for w.ctx.Err() == nil {
+		_, err := w.redisQuery("PING")
+		if err == nil {
+			return
+		}
+		w.handleError(err)
+		select {
+		case <-time.After(redisTimeout * time.Second):
+		case <-w.ctx.Done():
 		}
 	}
+}
 
-	return res
+// replace settings that can't be used as configured with their defaults
+func (w *WorkerConfig) setDefaults() {
+	if w.PollInterval <= 0 {
+		log.Printf("event=invalid_config setting=PollInterval value=%s default=%s pid=%d", w.PollInterval, defaultPollInterval, pid)
+		w.PollInterval = defaultPollInterval
+	}
+	if w.Fetcher == nil {
+		w.Fetcher = WeightedFetcher(w)
+	}
+	if w.FetchTimeout <= 0 {
+		w.FetchTimeout = redisTimeout * time.Second
+	}
+	if w.ErrorBackoff <= 0 {
+		w.ErrorBackoff = redisTimeout * time.Second
+	}
+	if w.SchedulerPool == nil {
+		w.SchedulerPool = w.newSchedulerPool()
+	}
+	if w.ReportError == nil {
+		w.ReportError = func(error, *Job) {}
+	}
+	if w.orderedFree == nil {
+		w.orderedFree = make(chan struct{}, 1)
+	}
 }
 
 func (w *WorkerConfig) handleError(err error) {
 	log.Printf(`event=error error_type=%T error_message="%s" pid=%d`, err, err, pid)
-	w.ReportError(err, nil)
+	w.reportError(err, nil)
+}
+
+func (w *WorkerConfig) reportError(err error, job *Job) {
+	w.reporterMtx.RLock()
+	reporters := append([]func(error, *Job){w.ReportError}, w.reporters...)
+	w.reporterMtx.RUnlock()
+
+	for _, report := range reporters {
+		if report == nil {
+			continue // ReportError isn't set on configs that weren't made by NewWorkerConfig
+		}
+		// a broken reporter shouldn't take down the worker or keep the others from running
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("event=reporter_panic error_message=%q pid=%d", fmt.Sprint(r), pid)
+				}
+			}()
+			report(err, job)
+		}()
+	}
 }
 
 // checks the sorted set of scheduled jobs and retries and queues them when it's time
-// TODO: move this to a Lua script
 func (w *WorkerConfig) scheduler() {
-	pollSets := []string{w.nsKey("retry"), w.nsKey("schedule")}
+	interval := w.PollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval // time.NewTicker panics on non-positive durations
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	for _ = range time.Tick(w.PollInterval) {
-		w.RLock() // don't let quitHandler() stop us in the middle of a run
-		conn := w.RedisPool.Get()
-		now := fmt.Sprintf("%f", timeFloat(time.Now()))
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.ctx.Done():
+			return
+		}
+		if atomic.LoadInt32(&w.schedulerPaused) != 0 {
+			continue
+		}
+
+		w.RLock() // don't let Shutdown() stop us in the middle of a run
+		start := time.Now()
+		w.tick()
+		if elapsed := time.Since(start); elapsed > interval {
+			log.Printf("event=scheduler_behind duration=%s poll_interval=%s pid=%d", elapsed, interval, pid)
+		}
+		w.RUnlock()
+	}
+}
+
+// PauseScheduler stops the scheduler from moving due jobs from the retry and
+// schedule sets onto their queues, for example while a database that jobs
+// need is down, until ResumeScheduler is called. Jobs accumulate in the sets
+// in the meantime.
+func (w *WorkerConfig) PauseScheduler() {
+	if atomic.CompareAndSwapInt32(&w.schedulerPaused, 0, 1) {
+		log.Printf("event=scheduler_paused pid=%d", pid)
+	}
+}
+
+// ResumeScheduler undoes PauseScheduler. The jobs that came due while it was
+// paused are promoted on the next poll.
+func (w *WorkerConfig) ResumeScheduler() {
+	if atomic.CompareAndSwapInt32(&w.schedulerPaused, 1, 0) {
+		log.Printf("event=scheduler_resumed pid=%d", pid)
+	}
+}
+
+// keeps a panic, like one from an unexpected reply, from killing the scheduler
+// so that the next tick tries again
+func (w *WorkerConfig) recoverScheduler() {
+	if r := recover(); r != nil {
+		err := newPanicError(r)
+		log.Printf("event=scheduler_panic error_message=%q pid=%d", fmt.Sprint(r), pid)
+		w.reportError(err, nil)
+	}
+}
+
+// runs one scheduler poll, unless the previous one is still running
+func (w *WorkerConfig) tick() {
+	if !atomic.CompareAndSwapInt32(&w.ticking, 0, 1) {
+		log.Printf("event=scheduler_tick_skipped pid=%d", pid)
+		return
+	}
+	defer atomic.StoreInt32(&w.ticking, 0)
+	defer w.recoverScheduler()
+	w.PromoteDue() // errors are already reported
+	w.checkRetryBacklog()
+}
+
+// warns if the retry set has grown past RetryWarnThreshold
+func (w *WorkerConfig) checkRetryBacklog() {
+	if w.RetryWarnThreshold <= 0 {
+		return
+	}
+	conn := w.SchedulerPool.Get()
+	defer conn.Close()
+	size, err := redis.Int(conn.Do("ZCARD", w.nsKey("retry")))
+	if err != nil {
+		w.handleError(err)
+		return
+	}
+	if size <= w.RetryWarnThreshold {
+		return
+	}
+	log.Printf("event=retry_backlog size=%d threshold=%d pid=%d", size, w.RetryWarnThreshold, pid)
+	if w.OnRetryBacklog != nil {
+		w.OnRetryBacklog(size)
+	}
+}
+
+// PromoteDue moves the retries and scheduled jobs that are due onto their
+// queues, like the scheduler does every PollInterval, and returns the number
+// of jobs moved and the first error. It lets tests and admin tools promote
+// jobs without waiting for the next poll. Scores are compared with
+// microsecond precision, so the scheduler promotes a job on the first poll
+// after its time, which makes PollInterval the effective resolution.
+// TODO: move this to a Lua script
+func (w *WorkerConfig) PromoteDue() (int, error) {
+	scheduleSet := w.nsKey("schedule")
+	pollSets := append(w.retrySets(), scheduleSet)
+
+	now := fmt.Sprintf("%f", timeFloat(time.Now()))
+	if !w.ConcurrentPromotion {
+		conn := w.SchedulerPool.Get()
+		defer conn.Close()
+		total := 0
+		var firstErr error
 		for _, set := range pollSets {
-			conn.Send("MULTI")
-			conn.Send("ZRANGEBYSCORE", set, "-inf", now)
-			conn.Send("ZREMRANGEBYSCORE", set, "-inf", now)
-			res, err := redis.Values(conn.Do("EXEC"))
-			if err != nil {
-				w.handleError(err)
-				continue
+			n, err := w.promoteSet(conn, set, set != scheduleSet, now)
+			total += n
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		return total, firstErr
+	}
+
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	total := 0
+	var firstErr error
+	for _, set := range pollSets {
+		wg.Add(1)
+		go func(set string) {
+			defer wg.Done()
+			defer w.recoverScheduler()
+			conn := w.SchedulerPool.Get()
+			defer conn.Close()
+			n, err := w.promoteSet(conn, set, set != scheduleSet, now)
+			mtx.Lock()
+			total += n
+			if firstErr == nil {
+				firstErr = err
 			}
+			mtx.Unlock()
+		}(set)
+	}
+	wg.Wait()
+	return total, firstErr
+}
 
-			for _, msg := range res[0].([]interface{}) {
-				parsedMsg := &struct {
-					Queue string `json:"queue"`
-				}{}
-				msgBytes := msg.([]byte)
-				err := json.Unmarshal(msgBytes, parsedMsg)
-				if err != nil {
-					w.handleError(err)
-					continue
-				}
-				if _, err = conn.Do("RPUSH", w.nsKey("queue:"+parsedMsg.Queue), msgBytes); err != nil {
+// the key of the retry set for jobs of a worker class
+func (w *WorkerConfig) retryKey(class string) string {
+	if key, ok := w.RetrySets[class]; ok {
+		return w.nsKey(key)
+	}
+	return w.nsKey("retry")
+}
+
+// the keys of the default retry set and every one in RetrySets
+func (w *WorkerConfig) retrySets() []string {
+	sets := []string{w.nsKey("retry")}
+	seen := map[string]bool{sets[0]: true}
+	for _, key := range w.RetrySets {
+		if key = w.nsKey(key); !seen[key] {
+			seen[key] = true
+			sets = append(sets, key)
+		}
+	}
+	sort.Strings(sets[1:])
+	return sets
+}
+
+// moves the jobs in a sorted set that are due by now to their queues, and
+// returns the number moved and the first error
+func (w *WorkerConfig) promoteSet(conn redis.Conn, set string, retry bool, now string) (int, error) {
+	push := "RPUSH"
+	if retry && w.RetryFront {
+		push = "LPUSH"
+	}
+
+	conn.Send("MULTI")
+	conn.Send("ZRANGEBYSCORE", set, "-inf", now)
+	conn.Send("ZREMRANGEBYSCORE", set, "-inf", now)
+	res, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		w.handleError(err)
+		return 0, err
+	}
+
+	count := 0
+	var firstErr error
+	for _, msg := range res[0].([]interface{}) {
+		job := &Job{}
+		msgBytes := msg.([]byte)
+		err := job.FromJSON(msgBytes)
+		if err == nil && job.Priority != 0 && w.isSorted(job.Queue) {
+			now := time.Now()
+			score, member := sortedEntry(job.Priority, now, setEnqueuedAt(msgBytes, now))
+			_, err = conn.Do("ZADD", w.sortedKey(job.Queue), score, member)
+		} else if err == nil {
+			_, err = conn.Do(push, w.nsKey("queue:"+job.Queue), setEnqueuedAt(msgBytes, time.Now()))
+		}
+		if err != nil {
+			w.handleError(err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		count++
+		if retry {
+			log.Printf("event=job_retried job_id=%s job_type=%s queue=%s retry_count=%d pid=%d", job.ID, job.Type, job.Queue, job.RetryCount, pid)
+			if w.EventStream != "" {
+				if err := addEvent(conn, w.nsKey(w.EventStream), EventRetried, job, job.Queue); err != nil {
 					w.handleError(err)
 				}
 			}
 		}
-		conn.Close()
-		w.RUnlock()
 	}
+	return count, firstErr
 }
 
 // listens for SIGINT, SIGTERM, and SIGQUIT to perform a clean shutdown
@@ -264,30 +1139,111 @@ func (w *WorkerConfig) quitHandler() {
 	signal.Notify(c, os.Interrupt)
 	signal.Notify(c, syscall.SIGTERM)
 	signal.Notify(c, syscall.SIGQUIT)
+	defer signal.Stop(c)
 
-	sig := <-c
-	signal.Stop(c)
-	log.Printf("state=stopping signal=%s pid=%d", sig, pid)
-	w.Lock()           // wait for the current run loop and scheduler iterations to finish
-	close(w.workQueue) // tell worker goroutines to stop after they finish their current job
-	w.clearWorkerSet()
-	done := make(chan struct{})
-	go func() {
-		w.done.Wait()
-		done <- struct{}{}
-	}()
 	select {
-	case <-done:
-	case <-time.After(w.StopTimeout):
-		log.Printf("state=stop_timeout timeout=%s pid=%d", w.StopTimeout, pid)
-		w.requeueJobs()
+	case sig := <-c:
+		log.Printf("event=signal signal=%s pid=%d", sig, pid)
+		w.Shutdown()
+		os.Exit(0)
+	case <-w.ctx.Done(): // Shutdown was called directly
+	}
+}
+
+// Shutdown stops fetching jobs and waits up to StopTimeout for running jobs
+// to finish, and for the queues to be drained if DrainOnShutdown is set. It
+// then cancels the contexts of the jobs that are still running, waits up to
+// CancelGrace for them to stop, and requeues the rest. Run returns once the
+// shutdown is complete.
+func (w *WorkerConfig) Shutdown() {
+	w.stopOnce.Do(func() {
+		log.Printf("state=stopping pid=%d", pid)
+		w.cancel()
+		w.Lock()           // wait for the current run loop and scheduler iterations to finish
+		close(w.workQueue) // tell worker goroutines to stop after they finish their current job
+		if w.priorityQueue != nil {
+			close(w.priorityQueue)
+		}
+		w.clearWorkerSet()
+		drainCtx, stopDrain := context.WithCancel(context.Background())
+		done := make(chan struct{}, 1)
+		go func() {
+			w.done.Wait()
+			if w.DrainOnShutdown {
+				w.drainOnShutdown(drainCtx)
+			}
+			done <- struct{}{}
+		}()
+		w.waitForWorkers(done)
+		stopDrain()
+		w.stopJobs()
+		w.flushStats()
+		log.Printf("state=stopped pid=%d", pid)
+		w.Unlock()
+		close(w.stopped)
+	})
+}
+
+// drains the queues for Shutdown until ctx is cancelled when StopTimeout runs out
+func (w *WorkerConfig) drainOnShutdown(ctx context.Context) {
+	n, err := w.DrainQueues(ctx)
+	if err != nil && err != ctx.Err() {
+		w.handleError(err)
+	}
+	log.Printf("state=drained jobs=%d pid=%d", n, pid)
+}
+
+// waits for done or StopTimeout, logging how many jobs are still running every
+// ShutdownProgressInterval
+func (w *WorkerConfig) waitForWorkers(done <-chan struct{}) {
+	interval := w.ShutdownProgressInterval
+	if interval <= 0 {
+		interval = defaultShutdownProgress
+	}
+	progress := time.NewTicker(interval)
+	defer progress.Stop()
+	timeout := time.After(w.StopTimeout)
+	start := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case <-progress.C:
+			w.workMtx.Lock()
+			running := len(w.work)
+			w.workMtx.Unlock()
+			log.Printf("state=stopping running=%d elapsed=%s timeout=%s pid=%d", running, time.Since(start), w.StopTimeout, pid)
+		case <-timeout:
+			// jobs that are still running are cancelled only now, and given
+			// CancelGrace to stop and put themselves back before the rest are
+			// requeued
+			log.Printf("state=stop_timeout timeout=%s pid=%d", w.StopTimeout, pid)
+			w.stopJobs()
+			grace := w.CancelGrace
+			if grace <= 0 {
+				grace = defaultCancelGrace
+			}
+			select {
+			case <-done:
+			case <-time.After(grace):
+			}
+			w.requeueJobs()
+			return
+		}
 	}
-	log.Printf("state=stopped pid=%d", pid)
-	os.Exit(0)
 }
 
 func (w *WorkerConfig) clearWorkerSet() {
 	key := w.nsKey("workers")
+	if w.WorkerIDFunc != nil {
+		workerIDs := make([]interface{}, w.WorkerCount+1)
+		workerIDs[0] = key
+		for i := 0; i < w.WorkerCount; i++ {
+			workerIDs[i+1] = w.workerID(i)
+		}
+		w.redisQuery("SREM", workerIDs...)
+		return
+	}
 	res, _ := redis.Strings(w.redisQuery("SMEMBERS", key))
 	workerIDs := make([]interface{}, 1, w.WorkerCount+1)
 	substr := ":" + strconv.Itoa(pid) + "-"
@@ -305,13 +1261,32 @@ func (w *WorkerConfig) clearWorkerSet() {
 func (w *WorkerConfig) requeueJobs() {
 	w.workMtx.Lock()
 	jobQueues := make(map[string][]*Job)
+	var sorted []*Job // put back into their sorted sets one at a time
 	workers := make(map[*Job]string)
 	for worker, job := range w.work {
+		delete(w.work, worker) // so that requeueCancelled doesn't push it again
+		if job.AtMostOnce {
+			log.Printf("event=job_abandon job_id=%s job_type=%s queue=%s worker_id=%s pid=%d", job.ID, job.Type, job.Queue, worker, pid)
+			continue
+		}
 		workers[job] = worker
+		if job.Priority != 0 && w.isSorted(job.Queue) {
+			sorted = append(sorted, job)
+			continue
+		}
 		jobQueues[job.Queue] = append(jobQueues[job.Queue], job)
 	}
 	w.workMtx.Unlock()
 
+	for _, job := range sorted {
+		err := w.pushBack(job)
+		log.Printf("event=job_requeue job_id=%s job_type=%s queue=%s success=%t worker_id=%s pid=%d", job.ID, job.Type, job.Queue, err == nil, workers[job], pid)
+		if err != nil && w.BackupFile != "" {
+			err = w.backupJobs([]*Job{job})
+			log.Printf("event=job_backup queue=%s count=1 file=%s success=%t pid=%d", job.Queue, w.BackupFile, err == nil, pid)
+		}
+	}
+
 	for queue, jobs := range jobQueues {
 		jobJSON := make([]interface{}, len(jobs)+1)
 		for i, job := range jobs {
@@ -322,7 +1297,21 @@ func (w *WorkerConfig) requeueJobs() {
 		for _, job := range jobs {
 			log.Printf("event=job_requeue job_id=%s job_type=%s queue=%s success=%t worker_id=%s pid=%d", job.ID, job.Type, queue, err == nil, workers[job], pid)
 		}
+		if err != nil && w.BackupFile != "" {
+			err = w.backupJobs(jobs)
+			log.Printf("event=job_backup queue=%s count=%d file=%s success=%t pid=%d", queue, len(jobs), w.BackupFile, err == nil, pid)
+		}
+	}
+}
+
+// makes sure a connection that sat in the pool for a while still works, so
+// that one broken by a network blip or failover gets replaced
+func (w *WorkerConfig) testOnBorrow(conn redis.Conn, idleSince time.Time) error {
+	if w.IdleCheck <= 0 || time.Since(idleSince) < w.IdleCheck {
+		return nil
 	}
+	_, err := conn.Do("PING")
+	return err
 }
 
 func (w *WorkerConfig) redisQuery(command string, args ...interface{}) (interface{}, error) {
@@ -331,9 +1320,15 @@ func (w *WorkerConfig) redisQuery(command string, args ...interface{}) (interfac
 	return conn.Do(command, args...)
 }
 
-var typeOfJob = reflect.TypeOf((*Job)(nil))
+var (
+	typeOfJob        = reflect.TypeOf((*Job)(nil))
+	typeOfContext    = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfResettable = reflect.TypeOf((*ResettableWorker)(nil)).Elem()
+	typeOfWorker     = reflect.TypeOf((*Worker)(nil)).Elem()
+)
 
-func setJob(worker Worker, job *Job) {
+// sets the exported *Job and context.Context fields of a worker struct
+func setJob(worker Worker, job *Job, ctx context.Context) {
 	val := reflect.ValueOf(worker)
 	if val.Kind() != reflect.Ptr {
 		return
@@ -345,139 +1340,655 @@ func setJob(worker Worker, job *Job) {
 	wtype := wstruct.Type()
 	for i := 0; i < wtype.NumField(); i++ {
 		field := wtype.Field(i)
-		if field.Type == typeOfJob {
+		if field.PkgPath != "" {
+			continue
+		}
+		switch field.Type {
+		case typeOfJob:
 			wstruct.Field(i).Set(reflect.ValueOf(job))
-			break
+		case typeOfContext:
+			wstruct.Field(i).Set(reflect.ValueOf(&ctx).Elem())
 		}
 	}
 }
 
 func (w *WorkerConfig) worker(id string) {
-	for msg := range w.workQueue {
-		if msg.die {
+	jobs := 0
+	for {
+		msg, ok := w.nextMessage()
+		if !ok || msg.die {
 			break
 		}
+		w.process(msg.job, id)
+		w.releaseJob(msg.job)
+
+		jobs++
+		if w.WorkerMaxJobs > 0 && jobs >= w.WorkerMaxJobs {
+			log.Printf("event=worker_recycle worker_id=%s jobs=%d pid=%d", id, jobs, pid)
+			go w.worker(id) // the new goroutine takes over our count in w.done
+			return
+		}
+	}
+	w.done.Done()
+}
 
-		job := msg.job
-		typ, ok := w.workerMapping[msg.job.Type]
-		if !ok {
-			err := UnknownWorkerError{job.Type}
-			w.scheduleRetry(job, err, true)
-			continue
+func (w *WorkerConfig) process(job *Job, id string) {
+	if job.ID == "" {
+		job.ID = newJobID(w.JIDGenerator)
+	}
+	if job.ExpiresAt != 0 && timeFloat(time.Now()) > job.ExpiresAt {
+		log.Printf("event=job_expired job_id=%s job_type=%s queue=%s expired_at=%s pid=%d", job.ID, job.Type, job.Queue, floatTime(job.ExpiresAt).UTC().Format(time.RFC3339), pid)
+		w.incrStat("stat:expired")
+		w.unlockUnique(job, job.UniqueUntil)
+		return
+	}
+	if job.Type == "" {
+		// no worker can ever be registered for it, so don't bother retrying
+		log.Printf("event=missing_class job_id=%s queue=%s pid=%d", job.ID, job.Queue, pid)
+		w.reportError(ErrMissingClass, job)
+		w.killJob(job, ErrMissingClass)
+		return
+	}
+
+	w.mappingMtx.RLock()
+	typ, ok := w.workerMapping[job.Type]
+	atMostOnce := w.atMostOnce[job.Type]
+	pool := w.workerPools[job.Type]
+	validate := w.validators[job.Type]
+	w.mappingMtx.RUnlock()
+	if !ok {
+		err := UnknownWorkerError{job.Type}
+		if w.StrictRegistration {
+			log.Printf("event=unknown_worker job_id=%s job_type=%s queue=%s pid=%d", job.ID, job.Type, job.Queue, pid)
+			w.reportError(err, job)
+			w.killJob(job, err)
+			return
+		}
+		w.scheduleRetry(job, err, true)
+		return
+	}
+	if validate != nil {
+		var args json.RawMessage
+		if job.Args != nil {
+			args = *job.Args
 		}
+		if err := validate(args); err != nil {
+			err = InvalidArgsError{job.Type, err}
+			log.Printf("event=invalid_args job_id=%s job_type=%s queue=%s error_message=%q pid=%d", job.ID, job.Type, job.Queue, err, pid)
+			w.reportError(err, job)
+			w.killJob(job, err)
+			return
+		}
+	}
 
-		w.trackJobStart(job, id)
+	if !w.breakerAllows(job.Type) {
+		w.deferJob(job)
+		return
+	}
 
-		// wrap Perform() in a function so that we can recover from panics
-		var err error
-		var worker Worker
-		func() {
-			defer func() {
-				if r := recover(); r != nil {
-					err = newPanicError(r)
-				}
-			}()
-			worker = reflect.New(typ).Interface().(Worker)
-			err = json.Unmarshal(*job.Args, worker)
-			if err != nil {
-				return
+	if atMostOnce {
+		job.AtMostOnce = true
+	}
+	w.trackJobStart(job, id)
+	w.unlockUnique(job, UniqueUntilStarted)
+
+	timeout := w.jobTimeout(job.Type)
+	ctx, cancel := w.jobContext(timeout)
+	defer cancel()
+
+	// wrap Perform() in a function so that we can recover from panics
+	var err error
+	var worker Worker
+	panicked := false
+	perform := func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = newPanicError(r)
+				panicked = true
 			}
-			setJob(worker, job)
-			err = worker.Perform()
 		}()
+		worker = w.newWorker(typ, pool)
+		err = w.decodeArgs(*job.Args, worker)
+		if err != nil {
+			return
+		}
+		setJob(worker, job, ctx)
+		err = worker.Perform()
+	}
+	w.runPerform(perform)
+	if !panicked {
+		w.releaseWorker(worker, pool)
+	}
+	if err != nil && ctx.Err() == context.Canceled && isCause(err, context.Canceled) {
+		// we cancelled the job by shutting down, it didn't fail
+		w.requeueCancelled(job, id)
+		return
+	}
+	if timeout > 0 && ctx.Err() == context.DeadlineExceeded {
+		// it ran past its timeout, so it fails whatever it returned
+		log.Printf("event=job_timeout job_id=%s job_type=%s queue=%s timeout=%s pid=%d", job.ID, job.Type, job.Queue, timeout, pid)
+		if err == nil {
+			err = ctx.Err()
+		}
+		err = JobTimeoutError{job.Type, timeout, err}
+	}
+	w.recordBreaker(job.Type, err == nil)
+	if err != nil {
+		report := true
+		if checker, ok := worker.(ReportableErrorChecker); ok {
+			report = checker.ReportableError(err)
+		}
+		w.scheduleRetry(job, err, report)
+	} else {
+		w.unlockUnique(job, UniqueUntilFinished)
+	}
+	w.trackJobFinish(job, id, err == nil)
+}
+
+// puts a job that stopped because Shutdown cancelled its context back at the
+// front of its queue, unless requeueJobs already did
+func (w *WorkerConfig) requeueCancelled(job *Job, workerID string) {
+	w.workMtx.Lock()
+	_, running := w.work[workerID]
+	delete(w.work, workerID)
+	w.workMtx.Unlock()
+
+	if running && !job.AtMostOnce {
+		err := w.pushBack(job)
+		log.Printf("event=job_requeue job_id=%s job_type=%s queue=%s success=%t worker_id=%s reason=cancelled pid=%d", job.ID, job.Type, job.Queue, err == nil, workerID, pid)
+	}
+	w.execTracking(func(conn redis.Conn) {
+		conn.Send("SREM", w.nsKey("workers"), workerID)
+		conn.Send("DEL", w.nsKey("worker:"+workerID+":started"))
+		conn.Send("DEL", w.nsKey("worker:"+workerID))
+	})
+}
+
+// reports whether err is, or wraps, target
+func isCause(err, target error) bool {
+	for err != nil {
+		if err == target {
+			return true
+		}
+		switch wrapper := err.(type) {
+		case interface{ Unwrap() error }:
+			err = wrapper.Unwrap()
+		case interface{ Cause() error }:
+			err = wrapper.Cause()
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// reusable workers of one type, with a zero value to reset them from
+type workerPool struct {
+	sync.Pool
+	zero       reflect.Value
+	resettable bool // whether the type has a Reset method with a pointer receiver
+}
+
+func newWorkerPool(t reflect.Type) *workerPool {
+	p := &workerPool{
+		zero:       reflect.New(t).Elem(),
+		resettable: reflect.PtrTo(t).Implements(typeOfResettable) && !t.Implements(typeOfResettable),
+	}
+	p.New = func() interface{} { return reflect.New(t).Interface() }
+	return p
+}
+
+func (w *WorkerConfig) decodeArgs(data []byte, worker Worker) error {
+	if !w.UseNumber {
+		return json.Unmarshal(data, worker)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(worker)
+}
+
+// ArgInt64 converts a number decoded into an interface{} field of a worker to
+// an int64. It is exact for json.Number args decoded with UseNumber.
+func ArgInt64(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case json.Number:
+		return n.Int64()
+	case float64:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	case int:
+		return int64(n), nil
+	}
+	return 0, fmt.Errorf("gokiq: Arg %#v isn't a number", v)
+}
+
+// ArgBytes converts binary data decoded into an interface{} field of a worker,
+// which JSON carries as a base64 string, back to bytes.
+func ArgBytes(v interface{}) ([]byte, error) {
+	switch b := v.(type) {
+	case string:
+		return base64.StdEncoding.DecodeString(b)
+	case []byte:
+		return b, nil
+	}
+	return nil, fmt.Errorf("gokiq: Arg %#v isn't binary data", v)
+}
+
+// calls perform on a new goroutine and waits for it if IsolatePerform is set
+func (w *WorkerConfig) runPerform(perform func()) {
+	if !w.IsolatePerform {
+		perform()
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		perform()
+	}()
+	<-done
+}
+
+func (w *WorkerConfig) newWorker(typ reflect.Type, pool *workerPool) Worker {
+	if pool == nil {
+		return reflect.New(typ).Interface().(Worker)
+	}
+	if w.ReuseWorkers {
+		return pool.Get().(Worker)
+	}
+	return pool.New().(Worker)
+}
+
+// clears the state of a performed worker and puts it back in its pool
+func (w *WorkerConfig) releaseWorker(worker Worker, pool *workerPool) {
+	if !w.ReuseWorkers || pool == nil || worker == nil {
+		return
+	}
+	if r, ok := worker.(ResettableWorker); ok && pool.resettable {
+		r.Reset()
+	} else {
+		reflect.ValueOf(worker).Elem().Set(pool.zero)
+	}
+	pool.Put(worker)
+}
+
+// DrainQueue performs the jobs that are in the named queue when it is called,
+// one at a time and bypassing the weighted fetch, until they are done or ctx is
+// cancelled. It returns the number of jobs performed.
+func (w *WorkerConfig) DrainQueue(ctx context.Context, name string) (int, error) {
+	key := w.nsKey("queue:" + name)
+	size, err := redis.Int(w.redisQuery("LLEN", key))
+	if err != nil {
+		return 0, err
+	}
+
+	id := fmt.Sprintf("%s:%d-drain", hostname, pid)
+	count := 0
+	for ; count < size; count++ {
+		if ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+		data, err := redis.Bytes(w.redisQuery("LPOP", key))
+		if err == redis.ErrNil {
+			break // someone else got to the rest of the jobs
+		}
 		if err != nil {
-			report := true
-			if checker, ok := worker.(ReportableErrorChecker); ok {
-				report = checker.ReportableError(err)
+			return count, err
+		}
+
+		job := &Job{}
+		if err := job.FromJSON(data); err != nil {
+			w.handleError(err)
+			continue
+		}
+		job.Queue = name
+		w.process(job, id)
+	}
+	return count, nil
+}
+
+// DrainQueues drains every queue with a weight above zero like DrainQueue, from
+// the highest weight to the lowest. If DrainShortestFirst is set, the queue
+// with the fewest jobs left is drained next instead, so that as many queues as
+// possible are finished if ctx is cancelled. It returns the number of jobs
+// performed.
+func (w *WorkerConfig) DrainQueues(ctx context.Context) (int, error) {
+	var remaining []string
+	for _, queue := range w.queuesByWeight() {
+		if w.Queues[queue] > 0 {
+			remaining = append(remaining, queue)
+		}
+	}
+
+	total := 0
+	for len(remaining) > 0 {
+		next := 0
+		if w.DrainShortestFirst {
+			var err error
+			if next, err = w.shortestQueue(remaining); err != nil {
+				return total, err
 			}
-			w.scheduleRetry(job, err, report)
 		}
-		w.trackJobFinish(job, id, err == nil)
+		n, err := w.DrainQueue(ctx, remaining[next])
+		total += n
+		if err != nil {
+			return total, err
+		}
+		remaining = append(remaining[:next], remaining[next+1:]...)
 	}
-	w.done.Done()
+	return total, nil
+}
+
+// returns the index of the queue with the fewest jobs
+func (w *WorkerConfig) shortestQueue(queues []string) (int, error) {
+	conn := w.RedisPool.Get()
+	defer conn.Close()
+	for _, queue := range queues {
+		conn.Send("LLEN", w.nsKey("queue:"+queue))
+	}
+	lengths, err := redis.Ints(conn.Do(""))
+	if err != nil {
+		return 0, err
+	}
+	shortest := 0
+	for i, length := range lengths {
+		if length < lengths[shortest] {
+			shortest = i
+		}
+	}
+	return shortest, nil
+}
+
+// WaitEmpty blocks until every configured queue, including PriorityQueues and
+// the sorted sets of SortedQueues, and the retry and schedule sets are empty
+// and this process isn't performing any jobs, polling Redis, or until ctx is
+// done, in which case it returns ctx's error.
+func (w *WorkerConfig) WaitEmpty(ctx context.Context) error {
+	ticker := time.NewTicker(waitEmptyInterval)
+	defer ticker.Stop()
+	for {
+		empty, err := w.isEmpty()
+		if err != nil || empty {
+			return err
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (w *WorkerConfig) isEmpty() (bool, error) {
+	if atomic.LoadInt32(&w.inFlight) > 0 {
+		return false, nil
+	}
+
+	conn := w.RedisPool.Get()
+	defer conn.Close()
+	for queue := range w.Queues {
+		if !w.isPriority(queue) {
+			conn.Send("LLEN", w.nsKey("queue:"+queue))
+		}
+	}
+	for _, queue := range w.PriorityQueues {
+		conn.Send("LLEN", w.nsKey("queue:"+queue))
+	}
+	for _, queue := range w.SortedQueues {
+		conn.Send("ZCARD", w.sortedKey(queue))
+	}
+	for _, set := range w.retrySets() {
+		conn.Send("ZCARD", set)
+	}
+	conn.Send("ZCARD", w.nsKey("schedule"))
+	sizes, err := redis.Ints(conn.Do(""))
+	if err != nil {
+		return false, err
+	}
+	for _, size := range sizes {
+		if size > 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// the context passed to a job, which expires after timeout if it isn't zero
+// and is cancelled by Shutdown once StopTimeout has passed
+func (w *WorkerConfig) jobContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	parent := w.jobCtx
+	if parent == nil {
+		parent = context.Background()
+	}
+	if timeout > 0 {
+		return context.WithTimeout(parent, timeout)
+	}
+	return context.WithCancel(parent)
 }
 
 func (w *WorkerConfig) scheduleRetry(job *Job, err error, report bool) {
 	if report {
-		w.ReportError(err, job)
+		w.reportError(err, job)
 	}
 
-	now := time.Now().UTC().Format(TimestampFormat)
-	if job.FailedAt == "" {
-		job.FailedAt = now
+	now, nowFloat := w.timestamp(time.Now())
+	firstFailure := !job.hasFailed()
+	if firstFailure {
+		job.FailedAt, job.FailedAtFloat = now, nowFloat
 	} else {
 		job.RetryCount += 1
 	}
 	if job.RetryCount > 0 {
-		job.RetriedAt = now
+		job.RetriedAt, job.RetriedAtFloat = now, nowFloat
 	}
 
-	log.Printf("event=job_error job_id=%s job_type=%s queue=%s retries=%d max_retries=%d error_type=%T error_message=%q pid=%d", job.ID, job.Type, job.Queue, job.RetryCount, job.MaxRetries, err, err, pid)
+	retry := job.RetryCount < job.MaxRetries && !job.AtMostOnce
+	if firstFailure || !retry || w.ErrorLogSample <= 0 || job.RetryCount%w.ErrorLogSample == 0 {
+		log.Printf("event=job_error job_id=%s job_type=%s queue=%s retries=%d max_retries=%d first_failure=%t error_type=%T error_message=%q correlation_id=%s tags=%s pid=%d", job.ID, job.Type, job.Queue, job.RetryCount, job.MaxRetries, firstFailure, err, err, w.correlationID(job), strings.Join(job.Tags, ","), pid)
+	}
+
+	w.emitEvent(EventFailed, job)
 
-	if job.RetryCount < job.MaxRetries {
+	// a spike in first failures points to a new problem, a spike in retry failures to an old backlog
+	counter := "stat:retry_failures"
+	if firstFailure {
+		counter = "stat:first_failures"
+	}
+	w.incrStat(counter)
+	if w.TrackLastErrors {
+		w.recordLastError(job, err)
+	}
+
+	if retry {
 		job.ErrorType = fmt.Sprintf("%T", err)
 		job.ErrorMessage = err.Error()
+		w.setBacktrace(job, err)
+		if job.RetryQueue != "" {
+			job.Queue = job.RetryQueue
+		}
+
+		if w.OnBeforeRetry != nil {
+			if retried := w.OnBeforeRetry(job, err); retried != nil {
+				job = retried
+			}
+		}
 
 		nextRetry := timeFloat(time.Now()) + retryDelay(job.RetryCount)
 
-		w.redisQuery("ZADD", w.nsKey("retry"), strconv.FormatFloat(nextRetry, 'f', -1, 64), job.JSON())
+		if err := w.addRetry(job, nextRetry); err != nil {
+			log.Printf("event=retry_lost job_id=%s job_type=%s queue=%s oom=%t error_message=%q pid=%d", job.ID, job.Type, job.Queue, isOOM(err), err, pid)
+			w.reportError(err, job)
+		}
+	} else {
+		// it won't run again, so nothing is left for its lock to hold back
+		w.unlockUnique(job, job.UniqueUntil)
+	}
+}
+
+// adds a job to its retry set. Redis refuses writes once it reaches maxmemory
+// until something expires or is evicted, so those are tried again after a
+// backoff instead of losing the retry.
+func (w *WorkerConfig) addRetry(job *Job, at float64) error {
+	var err error
+	backoff := oomBackoff
+	for attempt := 1; attempt <= oomAttempts; attempt++ {
+		_, err = w.redisQuery("ZADD", w.retryKey(job.Type), strconv.FormatFloat(at, 'f', -1, 64), job.JSON())
+		if !isOOM(err) || attempt == oomAttempts {
+			break
+		}
+		log.Printf("event=redis_oom job_id=%s job_type=%s attempt=%d backoff=%s pid=%d", job.ID, job.Type, attempt, backoff, pid)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return err
+}
+
+// whether Redis refused a write because it is at maxmemory
+func isOOM(err error) bool {
+	redisErr, ok := err.(redis.Error)
+	return ok && strings.HasPrefix(string(redisErr), "OOM ")
+}
+
+func (w *WorkerConfig) correlationID(job *Job) string {
+	if job.correlationID != "" {
+		return job.correlationID
 	}
+	job.correlationID = job.ID
+	if w.CorrelationField != "" && job.raw != nil {
+		fields := make(map[string]interface{})
+		if err := json.Unmarshal(job.raw, &fields); err == nil && fields[w.CorrelationField] != nil {
+			job.correlationID = fmt.Sprint(fields[w.CorrelationField])
+		}
+	}
+	return job.correlationID
 }
 
-type runningJob struct {
+// formats the time of a failure for failed_at and retried_at, as a string or
+// as a float if FloatTimestamps is set
+func (w *WorkerConfig) timestamp(t time.Time) (string, float64) {
+	if w.FloatTimestamps {
+		return "", timeFloat(t)
+	}
+	return t.UTC().Format(TimestampFormat), 0
+}
+
+// RunningJob is the payload stored at worker:<id> while a job is performed.
+type RunningJob struct {
 	Queue     string `json:"queue"`
 	Job       *Job   `json:"payload"`
 	Timestamp int64  `json:"run_at"`
 }
 
-func (w *WorkerConfig) trackJobStart(job *Job, workerID string) {
+// BusyJobs returns the jobs currently being performed by all workers sharing
+// the Redis namespace, keyed by worker id.
+func (w *WorkerConfig) BusyJobs() (map[string]*RunningJob, error) {
 	conn := w.RedisPool.Get()
 	defer conn.Close()
 
+	ids, err := redis.Strings(conn.Do("SMEMBERS", w.nsKey("workers")))
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	keys := make([]interface{}, len(ids))
+	for i, id := range ids {
+		keys[i] = w.nsKey("worker:" + id)
+	}
+	payloads, err := redis.Values(conn.Do("MGET", keys...))
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make(map[string]*RunningJob, len(ids))
+	for i, payload := range payloads {
+		data, ok := payload.([]byte)
+		if !ok {
+			continue // the job finished between SMEMBERS and MGET
+		}
+		job := &RunningJob{}
+		if err := json.Unmarshal(data, job); err != nil {
+			return nil, err
+		}
+		jobs[ids[i]] = job
+	}
+	return jobs, nil
+}
+
+func (w *WorkerConfig) trackJobStart(job *Job, workerID string) {
 	w.workMtx.Lock()
 	w.work[workerID] = job
 	w.workMtx.Unlock()
 
-	conn.Send("MULTI")
-	conn.Send("SADD", w.nsKey("workers"), workerID)
-	conn.Send("SETEX", w.nsKey("worker:"+workerID+":started"), keyExpiry, time.Now().UTC().String())
-	payload := &runningJob{job.Queue, job, time.Now().Unix()}
+	payload := &RunningJob{job.Queue, job, time.Now().Unix()}
 	json, _ := json.Marshal(payload)
-	conn.Send("SETEX", w.nsKey("worker:"+workerID), keyExpiry, json)
-	_, err := conn.Do("EXEC")
-	if err != nil {
-		w.handleError(err)
-	}
+	w.execTracking(func(conn redis.Conn) {
+		conn.Send("SADD", w.nsKey("workers"), workerID)
+		conn.Send("SETEX", w.nsKey("worker:"+workerID+":started"), keyExpiry, time.Now().UTC().String())
+		conn.Send("SETEX", w.nsKey("worker:"+workerID), keyExpiry, json)
+	})
 
 	job.StartTime = time.Now()
-	log.Printf("event=job_start job_id=%s job_type=%s queue=%s worker_id=%s pid=%d", job.ID, job.Type, job.Queue, workerID, pid)
+	w.emitEvent(EventStarted, job)
+	log.Printf("event=job_start job_id=%s job_type=%s queue=%s worker_id=%s correlation_id=%s tags=%s pid=%d", job.ID, job.Type, job.Queue, workerID, w.correlationID(job), strings.Join(job.Tags, ","), pid)
 }
 
 func (w *WorkerConfig) trackJobFinish(job *Job, workerID string, success bool) {
-	log.Printf("event=job_finish job_id=%s job_type=%s queue=%s duration=%v success=%t worker_id=%s pid=%d", job.ID, job.Type, job.Queue, time.Since(job.StartTime), success, workerID, pid)
-
-	conn := w.RedisPool.Get()
-	defer conn.Close()
+	log.Printf("event=job_finish job_id=%s job_type=%s queue=%s duration=%v success=%t worker_id=%s correlation_id=%s tags=%s pid=%d", job.ID, job.Type, job.Queue, time.Since(job.StartTime), success, workerID, w.correlationID(job), strings.Join(job.Tags, ","), pid)
 
 	w.workMtx.Lock()
 	delete(w.work, workerID)
 	w.workMtx.Unlock()
+	w.recordFinish(time.Now())
 
 	date := time.Now().Format(dateFormat)
-	conn.Send("MULTI")
-	conn.Send("SREM", w.nsKey("workers"), workerID)
-	conn.Send("DEL", w.nsKey("worker:"+workerID+":started"))
-	conn.Send("DEL", w.nsKey("worker:"+workerID))
-	conn.Send("INCR", w.nsKey("stat:processed"))
-	conn.Send("INCR", w.nsKey("stat:processed:"+date))
+	stats := []string{"stat:processed", "stat:processed:" + date}
 	if !success {
-		conn.Send("INCR", w.nsKey("stat:failed"))
-		conn.Send("INCR", w.nsKey("stat:failed:"+date))
+		stats = append(stats, "stat:failed", "stat:failed:"+date)
 	}
-	_, err := conn.Do("EXEC")
-	if err != nil {
-		w.handleError(err)
+	if w.StatFlushInterval > 0 {
+		// added once here, since the transaction below can be run more than once
+		for _, key := range stats {
+			w.addStat(key, 1)
+		}
+	}
+	w.execTracking(func(conn redis.Conn) {
+		conn.Send("SREM", w.nsKey("workers"), workerID)
+		conn.Send("DEL", w.nsKey("worker:"+workerID+":started"))
+		conn.Send("DEL", w.nsKey("worker:"+workerID))
+		if w.StatFlushInterval <= 0 {
+			for _, key := range stats {
+				conn.Send("INCR", w.nsKey(key))
+			}
+		}
+		if w.HistorySize > 0 {
+			w.sendHistory(conn, job, success)
+		}
+		if w.TrackClassStats {
+			w.sendClassStats(conn, job)
+		}
+	})
+	if success {
+		w.emitEvent(EventFinished, job)
 	}
+	w.notifySubscribers(job, success)
+}
+
+// runs the commands that send queues in a MULTI/EXEC, retrying on a new
+// connection if it fails, so that a transient error doesn't leave a worker
+// registered as busy after its job is done
+func (w *WorkerConfig) execTracking(send func(conn redis.Conn)) {
+	var err error
+	for attempt := 1; attempt <= trackAttempts; attempt++ {
+		conn := w.RedisPool.Get()
+		conn.Send("MULTI")
+		send(conn)
+		_, err = conn.Do("EXEC")
+		conn.Close()
+		if err == nil {
+			return
+		}
+		log.Printf(`event=track_error attempt=%d error_message="%s" pid=%d`, attempt, err, pid)
+	}
+	w.handleError(err)
 }
 
 func (w *WorkerConfig) nsKey(key string) string {
@@ -492,8 +2003,30 @@ func retryDelay(count int) float64 {
 	return math.Pow(float64(count), 4) + 15 + float64(rand.Intn(30)*(count+1))
 }
 
+// Unix time in seconds with sub-second precision, as used for sorted set scores
 func timeFloat(t time.Time) float64 {
-	return float64(time.Now().UnixNano()) / float64(time.Second)
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// sets enqueued_at in a payload, keeping the fields that Job doesn't have
+func setEnqueuedAt(data []byte, t time.Time) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return data
+	}
+	fields["enqueued_at"], _ = json.Marshal(timeFloat(t))
+	res, err := json.Marshal(fields)
+	if err != nil {
+		return data
+	}
+	return res
+}
+
+func floatTime(f float64) time.Time {
+	if f == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(f*float64(time.Second)))
 }
 
 type StackFrame struct {
@@ -512,17 +2045,7 @@ func (err *PanicError) Error() string {
 }
 
 func newPanicError(v interface{}) *PanicError {
-	err := &PanicError{Err: v}
-	for i := 2; ; i++ {
-		var frame StackFrame
-		var ok bool
-		frame.PC, frame.File, frame.Line, ok = runtime.Caller(i)
-		if !ok {
-			break
-		}
-		err.Stack = append(err.Stack, frame)
-	}
-	return err
+	return &PanicError{Err: v, Stack: callerStack(2)}
 }
 
 var (
@@ -530,16 +2053,59 @@ var (
 	hostname, _ = os.Hostname()
 )
 
-func workerID(i int) string {
+// the id of the worker goroutine with index i, which names its keys in Redis
+func (w *WorkerConfig) workerID(i int) string {
+	if w.WorkerIDFunc != nil {
+		return w.WorkerIDFunc(i)
+	}
 	return fmt.Sprintf("%s:%d-%d", hostname, pid, i)
 }
 
+// a nil pointer would make workerType panic
+func isNilWorker(worker Worker) bool {
+	if worker == nil {
+		return true
+	}
+	val := reflect.ValueOf(worker)
+	return val.Kind() == reflect.Ptr && val.IsNil()
+}
+
 func workerType(worker Worker) reflect.Type {
 	return reflect.Indirect(reflect.ValueOf(worker)).Type()
 }
 
+var (
+	ErrNoQueues  = errors.New("gokiq: No queues with a weight above zero")
+	ErrNilWorker = errors.New("gokiq: Worker is nil")
+
+	// ErrMissingClass is returned by EnqueuePayload for payloads without a
+	// class, and is the error that jobs without one are killed with.
+	ErrMissingClass = errors.New("gokiq: Job has no class")
+
+	// ErrDuplicateJob is returned when a unique job is enqueued while another
+	// with the same args holds the lock.
+	ErrDuplicateJob = errors.New("gokiq: Duplicate of a unique job")
+)
+
 type UnknownWorkerError struct{ Type string }
 
 func (e UnknownWorkerError) Error() string {
 	return "gokiq: Unknown worker type: " + e.Type
 }
+
+// InvalidArgsError is the error that jobs whose args were rejected by their
+// class's validator are killed with.
+type InvalidArgsError struct {
+	Type string
+	Err  error
+}
+
+func (e InvalidArgsError) Error() string {
+	return "gokiq: Invalid args for " + e.Type + ": " + e.Err.Error()
+}
+
+type InvalidWorkerError struct{ Type string }
+
+func (e InvalidWorkerError) Error() string {
+	return "gokiq: Type does not implement Worker: " + e.Type
+}
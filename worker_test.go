@@ -1,9 +1,20 @@
 package gokiq
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -110,7 +121,7 @@ func (s *WorkerSuite) TestJobRedisLogging(c *C) {
 
 	msg, err := redis.Bytes(Workers.redisQuery("GET", "worker:test"))
 	MaybeFail(c, err)
-	jobMsg := &runningJob{}
+	jobMsg := &RunningJob{}
 	err = json.Unmarshal(msg, jobMsg)
 	MaybeFail(c, err)
 	c.Assert(jobMsg.Queue, Equals, "default")
@@ -132,6 +143,2486 @@ func (s *WorkerSuite) TestJobRedisLogging(c *C) {
 	c.Assert(mg, IsNil)
 }
 
+func (s *WorkerSuite) TestZeroPollIntervalDefault(c *C) {
+	w := NewWorkerConfig()
+	w.PollInterval = 0
+	w.setDefaults()
+	c.Assert(w.PollInterval, Equals, defaultPollInterval)
+}
+
+func (s *WorkerSuite) TestOnFetchReject(c *C) {
+	w := NewWorkerConfig()
+	w.denormalizeQueues()
+	w.OnFetch = func(job *Job) error { return errors.New("rejected") }
+
+	for _, dead := range []bool{false, true} {
+		_, err := w.redisQuery("FLUSHDB")
+		MaybeFail(c, err)
+		w.DeadRejected = dead
+
+		job := &Job{Type: "TestWorker", ID: "123", Retry: true}
+		_, err = w.redisQuery("RPUSH", "queue:default", job.JSON())
+		MaybeFail(c, err)
+		w.run()
+
+		queued, err := redis.Int(w.redisQuery("LLEN", "queue:default"))
+		MaybeFail(c, err)
+		c.Assert(queued, Equals, 0)
+		killed, err := redis.Int(w.redisQuery("ZCARD", "dead"))
+		MaybeFail(c, err)
+		scheduled, err := redis.Values(w.redisQuery("ZRANGE", "schedule", 0, -1, "WITHSCORES"))
+		MaybeFail(c, err)
+		if dead {
+			c.Assert(killed, Equals, 1)
+			c.Assert(scheduled, HasLen, 0)
+		} else {
+			// put off for RejectDelay instead of being fetched again right away
+			c.Assert(killed, Equals, 0)
+			c.Assert(scheduled, HasLen, 2)
+			score, err := redis.Float64(scheduled[1], nil)
+			MaybeFail(c, err)
+			if diff := score - timeFloat(time.Now().Add(defaultRejectDelay)); diff < -1 || diff > 0 {
+				c.Fatalf("Expected the job to be scheduled after the reject delay, it is %fs off", diff)
+			}
+		}
+	}
+}
+
+func (s *WorkerSuite) TestMultipleErrorReporters(c *C) {
+	w := NewWorkerConfig()
+	var reported []string
+	w.AddErrorReporter(func(err error, job *Job) { reported = append(reported, "first") })
+	w.AddErrorReporter(func(err error, job *Job) { panic("broken reporter") })
+	w.AddErrorReporter(func(err error, job *Job) { reported = append(reported, "second") })
+
+	w.handleError(errors.New("test error"))
+	c.Assert(reported, DeepEquals, []string{"first", "second"})
+}
+
+func (s *WorkerSuite) TestRegisterNonWorker(c *C) {
+	w := NewWorkerConfig()
+	err := w.registerType("NotAWorker", reflect.TypeOf(struct{}{}))
+	c.Assert(err, FitsTypeOf, InvalidWorkerError{})
+	c.Assert(w.workerMapping, HasLen, 0)
+
+	MaybeFail(c, w.Register(&TestWorker{}))
+	c.Assert(w.workerMapping["TestWorker"], Equals, reflect.TypeOf(TestWorker{}))
+}
+
+func (s *WorkerSuite) TestReplayDead(c *C) {
+	w := NewWorkerConfig()
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	for i, typ := range []string{"A", "B", "A"} {
+		job := &Job{Type: typ, ID: strconv.Itoa(i), Queue: "default", Retry: true}
+		w.killJob(job, errors.New("dead"))
+	}
+
+	n, err := w.ReplayDead(func(job *Job) bool { return job.Type == "A" })
+	MaybeFail(c, err)
+	c.Assert(n, Equals, 2)
+
+	queued, err := redis.Values(w.redisQuery("LRANGE", "queue:default", 0, -1))
+	MaybeFail(c, err)
+	c.Assert(queued, HasLen, 2)
+	for _, data := range queued {
+		job := &Job{}
+		MaybeFail(c, job.FromJSON(data.([]byte)))
+		c.Assert(job.Type, Equals, "A")
+	}
+
+	dead, err := redis.Int(w.redisQuery("ZCARD", "dead"))
+	MaybeFail(c, err)
+	c.Assert(dead, Equals, 1)
+}
+
+func (s *WorkerSuite) TestDeadSet(c *C) {
+	w := NewWorkerConfig()
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	start := time.Now()
+	for i, typ := range []string{"A", "B"} {
+		job := &Job{Type: typ, ID: strconv.Itoa(i), Queue: "default", Retry: true}
+		w.killJob(job, errors.New("dead"))
+	}
+
+	dead, err := w.DeadSet()
+	MaybeFail(c, err)
+	c.Assert(dead, HasLen, 2)
+	for i, job := range dead {
+		c.Assert(job.ID, Equals, strconv.Itoa(i))
+		c.Assert(job.ErrorMessage, Equals, "dead")
+		if job.At.Before(start.Add(-time.Millisecond)) || job.At.After(time.Now()) {
+			c.Fatalf("Expected job to have died after %s, got %s", start, job.At)
+		}
+	}
+
+	n, err := w.ClearDead()
+	MaybeFail(c, err)
+	c.Assert(n, Equals, 2)
+	dead, err = w.DeadSet()
+	MaybeFail(c, err)
+	c.Assert(dead, HasLen, 0)
+	n, err = w.ClearDead()
+	MaybeFail(c, err)
+	c.Assert(n, Equals, 0)
+}
+
+func (s *WorkerSuite) TestNilReportError(c *C) {
+	w := &WorkerConfig{RedisPool: NewWorkerConfig().RedisPool}
+	output := captureLog(func() {
+		w.handleError(errors.New("failed"))
+		w.scheduleRetry(&Job{Type: "TestWorker", Queue: "default", ID: "123", MaxRetries: 25}, errors.New("failed"), true)
+	})
+	c.Assert(strings.Contains(output, "event=reporter_panic"), Equals, false)
+
+	w.setDefaults()
+	c.Assert(w.ReportError, NotNil)
+}
+
+func (s *WorkerSuite) TestSubscribe(c *C) {
+	w := NewWorkerConfig()
+	MaybeFail(c, w.Register(&TestWorker{}))
+	MaybeFail(c, w.Register(&FailingWorker{}))
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+	done := w.Subscribe(10, false)
+	full := w.Subscribe(1, false)
+
+	data := json.RawMessage(`{"args":["bar"]}`)
+	for i := 0; i < 3; i++ {
+		w.process(&Job{Type: "TestWorker", Args: &data, Queue: "default", ID: strconv.Itoa(i)}, "test")
+	}
+	w.process(&Job{Type: "FailingWorker", Args: &data, Queue: "default", ID: "3", MaxRetries: 25}, "test")
+
+	c.Assert(done, HasLen, 4)
+	for i := 0; i < 4; i++ {
+		event := <-done
+		c.Assert(event.ID, Equals, strconv.Itoa(i))
+		c.Assert(event.Success, Equals, i < 3)
+	}
+	c.Assert(full, HasLen, 1)
+}
+
+func (s *WorkerSuite) TestJIDGenerator(c *C) {
+	w := NewWorkerConfig(WithJIDGenerator(func() string { return "filled" }))
+	MaybeFail(c, w.Register(&TestWorker{}))
+	done := w.Subscribe(1, false)
+
+	data := json.RawMessage(`{"args":["bar"]}`)
+	w.process(&Job{Type: "TestWorker", Args: &data, Queue: "default"}, "test")
+	c.Assert((<-done).ID, Equals, "filled")
+}
+
+func (s *WorkerSuite) TestExpiredJobs(c *C) {
+	w := NewWorkerConfig()
+	MaybeFail(c, w.Register(&TestWorker{}))
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+	done := w.Subscribe(2, false)
+
+	data := json.RawMessage(`{"args":["bar"]}`)
+	expired := timeFloat(time.Now().Add(-time.Second))
+	output := captureLog(func() {
+		w.process(&Job{Type: "TestWorker", Args: &data, Queue: "default", ID: "1", ExpiresAt: expired}, "test")
+	})
+	c.Assert(strings.Contains(output, "event=job_expired job_id=1"), Equals, true)
+	c.Assert(done, HasLen, 0)
+	count, err := redis.Int(w.redisQuery("GET", "stat:expired"))
+	MaybeFail(c, err)
+	c.Assert(count, Equals, 1)
+
+	w.process(&Job{Type: "TestWorker", Args: &data, Queue: "default", ID: "2", ExpiresAt: timeFloat(time.Now().Add(time.Minute))}, "test")
+	c.Assert((<-done).ID, Equals, "2")
+}
+
+func (s *WorkerSuite) TestReady(c *C) {
+	w := NewWorkerConfig()
+	w.RedisNamespace = "ready"
+	w.WorkerCount = 1
+	MaybeFail(c, w.Register(&TestWorker{}))
+	go w.Run()
+
+	select {
+	case <-w.Ready():
+	case <-time.After(time.Second):
+		c.Fatal("worker not ready")
+	}
+
+	job := &Job{Type: "TestWorker", ID: "123", Retry: false}
+	data := json.RawMessage(`{"args":["foo"]}`)
+	job.Args = &data
+	_, err := w.redisQuery("RPUSH", "ready:queue:default", job.JSON())
+	MaybeFail(c, err)
+
+	select {
+	case <-workChan:
+	case <-time.After(time.Second):
+		c.Error("assertion timeout")
+	}
+	w.Shutdown()
+}
+
+func (s *WorkerSuite) TestShutdownDuringFetch(c *C) {
+	w := NewWorkerConfig()
+	w.RedisNamespace = "shutdown"
+	w.WorkerCount = 1
+	w.FetchTimeout = 5 * time.Second
+	stopped := make(chan struct{})
+	go func() {
+		w.Run()
+		close(stopped)
+	}()
+	<-w.Ready()
+	time.Sleep(10 * time.Millisecond) // let run() block in BLPOP
+
+	start := time.Now()
+	w.Shutdown()
+	select {
+	case <-stopped:
+	case <-time.After(w.FetchTimeout):
+		c.Fatal("Run didn't return after Shutdown")
+	}
+	if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+		c.Fatalf("Expected shutdown to stop the fetch well before its timeout, took %s", elapsed)
+	}
+}
+
+func (s *WorkerSuite) TestShutdownDuringStartup(c *C) {
+	for i := 0; i < 5; i++ {
+		w := NewWorkerConfig()
+		w.RedisNamespace = "startup"
+		if i == 0 {
+			w.Shutdown()
+		} else {
+			go w.Shutdown()
+		}
+
+		stopped := make(chan error)
+		go func() { stopped <- w.Run() }()
+		select {
+		case err := <-stopped:
+			MaybeFail(c, err)
+		case <-time.After(2 * redisTimeout * time.Second):
+			c.Fatal("Run didn't return after Shutdown")
+		}
+	}
+}
+
+type ContextFieldWorker struct {
+	Ctx context.Context
+}
+
+var contextChan = make(chan context.Context, 1)
+
+func (w *ContextFieldWorker) Perform() error {
+	contextChan <- w.Ctx
+	return nil
+}
+
+var blockingStarted = make(chan struct{}, 1)
+
+type wrappedError struct{ err error }
+
+func (e wrappedError) Error() string { return "stopped: " + e.err.Error() }
+func (e wrappedError) Unwrap() error { return e.err }
+
+type BlockingWorker struct {
+	Ctx context.Context
+}
+
+func (w *BlockingWorker) Perform() error {
+	blockingStarted <- struct{}{}
+	<-w.Ctx.Done()
+	return wrappedError{w.Ctx.Err()}
+}
+
+func (s *WorkerSuite) TestShutdownCancelsJobs(c *C) {
+	w := NewWorkerConfig()
+	w.RedisNamespace = "cancel"
+	w.WorkerCount = 1
+	w.StopTimeout = 50 * time.Millisecond
+	MaybeFail(c, w.Register(&BlockingWorker{}))
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+	data := json.RawMessage(`{}`)
+	job := &Job{Type: "BlockingWorker", Args: &data, ID: "123", Retry: 25}
+	_, err = w.redisQuery("RPUSH", "cancel:queue:default", job.JSON())
+	MaybeFail(c, err)
+
+	go w.Run()
+	select {
+	case <-blockingStarted:
+	case <-time.After(time.Second):
+		c.Fatal("assertion timeout")
+	}
+	log := captureLog(w.Shutdown)
+	c.Assert(log, Matches, "(?s).*event=job_requeue job_id=123 .*reason=cancelled.*") // it saw the cancellation
+
+	queued, err := redis.Values(w.redisQuery("LRANGE", "cancel:queue:default", 0, -1))
+	MaybeFail(c, err)
+	c.Assert(queued, HasLen, 1)
+	MaybeFail(c, job.FromJSON(queued[0].([]byte)))
+	c.Assert(job.ID, Equals, "123")
+	c.Assert(job.ErrorMessage, Equals, "")
+	for _, key := range []string{"cancel:retry", "cancel:workers", "cancel:stat:failed"} {
+		exists, err := redis.Bool(w.redisQuery("EXISTS", key))
+		MaybeFail(c, err)
+		c.Assert(exists, Equals, false, Commentf(key))
+	}
+}
+
+var graceStarted = make(chan struct{}, 1)
+
+// finishes shortly unless its context is cancelled first
+type GraceWorker struct {
+	Ctx context.Context
+}
+
+func (w *GraceWorker) Perform() error {
+	graceStarted <- struct{}{}
+	select {
+	case <-w.Ctx.Done():
+		return w.Ctx.Err()
+	case <-time.After(100 * time.Millisecond):
+		return nil
+	}
+}
+
+func (s *WorkerSuite) TestShutdownWaitsBeforeCancelling(c *C) {
+	w := NewWorkerConfig()
+	w.RedisNamespace = "grace"
+	w.WorkerCount = 1
+	w.StopTimeout = time.Second
+	MaybeFail(c, w.Register(&GraceWorker{}))
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+	data := json.RawMessage(`{}`)
+	job := &Job{Type: "GraceWorker", Args: &data, ID: "123", Retry: 25}
+	_, err = w.redisQuery("RPUSH", "grace:queue:default", job.JSON())
+	MaybeFail(c, err)
+
+	go w.Run()
+	select {
+	case <-graceStarted:
+	case <-time.After(time.Second):
+		c.Fatal("assertion timeout")
+	}
+	w.Shutdown()
+
+	// the job finished within StopTimeout instead of being cancelled
+	processed, err := redis.Int(w.redisQuery("GET", "grace:stat:processed"))
+	MaybeFail(c, err)
+	c.Assert(processed, Equals, 1)
+	for _, key := range []string{"grace:queue:default", "grace:retry", "grace:stat:failed"} {
+		exists, err := redis.Bool(w.redisQuery("EXISTS", key))
+		MaybeFail(c, err)
+		c.Assert(exists, Equals, false, Commentf(key))
+	}
+}
+
+var sleepingStarted = make(chan struct{}, 2)
+
+type SleepingWorker struct{}
+
+func (w *SleepingWorker) Perform() error {
+	sleepingStarted <- struct{}{}
+	time.Sleep(300 * time.Millisecond)
+	return nil
+}
+
+var (
+	gateStarted  = make(chan struct{}, 1)
+	gateRelease  = make(chan struct{})
+	priorityRuns = make(chan string, 3)
+)
+
+// blocks the worker that performs a job named gate until it is released
+type PriorityWorker struct{ Name string }
+
+func (w *PriorityWorker) Perform() error {
+	if w.Name == "gate" {
+		gateStarted <- struct{}{}
+		<-gateRelease
+	}
+	priorityRuns <- w.Name
+	return nil
+}
+
+func (s *WorkerSuite) TestPriorityQueues(c *C) {
+	w := NewWorkerConfig()
+	w.RedisNamespace = "priority"
+	w.WorkerCount = 1
+	w.PriorityQueues = []string{"urgent"}
+	MaybeFail(c, w.Register(&PriorityWorker{}))
+	_, err := w.redisQuery("DEL", "priority:queue:urgent")
+	MaybeFail(c, err)
+	fetcher := make(chanFetcher, 2)
+	w.Fetcher = fetcher
+	newJob := func(name string) *Job {
+		data := json.RawMessage(`{"Name":"` + name + `"}`)
+		return &Job{Type: "PriorityWorker", Args: &data, Queue: "default", ID: name}
+	}
+
+	go w.Run()
+	defer w.Shutdown()
+	fetcher <- newJob("gate")
+	<-gateStarted
+
+	// a normal job and then an urgent one wait for the only worker
+	fetcher <- newJob("normal")
+	time.Sleep(20 * time.Millisecond)
+	_, err = w.redisQuery("RPUSH", "priority:queue:urgent", newJob("urgent").JSON())
+	MaybeFail(c, err)
+	time.Sleep(50 * time.Millisecond)
+
+	gateRelease <- struct{}{}
+	var runs []string
+	for i := 0; i < 3; i++ {
+		select {
+		case name := <-priorityRuns:
+			runs = append(runs, name)
+		case <-time.After(time.Second):
+			c.Fatal("assertion timeout")
+		}
+	}
+	c.Assert(runs, DeepEquals, []string{"gate", "urgent", "normal"})
+}
+
+func (s *WorkerSuite) TestOnlyPriorityQueues(c *C) {
+	w := NewWorkerConfig()
+	w.RedisNamespace = "onlypriority"
+	w.WorkerCount = 1
+	w.Queues = QueueConfig{"urgent": 1}
+	w.PriorityQueues = []string{"urgent"}
+	MaybeFail(c, w.Register(&PriorityWorker{}))
+	data := json.RawMessage(`{"Name":"urgent"}`)
+	job := &Job{Type: "PriorityWorker", Args: &data, Queue: "urgent", ID: "urgent"}
+	_, err := w.redisQuery("DEL", "onlypriority:queue:urgent")
+	MaybeFail(c, err)
+	_, err = w.redisQuery("RPUSH", "onlypriority:queue:urgent", job.JSON())
+	MaybeFail(c, err)
+
+	errs := make(chan error, 1)
+	go func() { errs <- w.Run() }()
+	select {
+	case name := <-priorityRuns:
+		c.Assert(name, Equals, "urgent")
+	case err := <-errs:
+		c.Fatalf("Run returned %v", err)
+	case <-time.After(time.Second):
+		c.Fatal("assertion timeout")
+	}
+	w.Shutdown()
+	MaybeFail(c, <-errs)
+}
+
+// hands out the jobs sent on it, and stops blocking when ctx is done
+type chanFetcher chan *Job
+
+func (f chanFetcher) Fetch(ctx context.Context) (*Job, error) {
+	select {
+	case job := <-f:
+		return job, nil
+	case <-ctx.Done():
+		return nil, nil
+	}
+}
+
+func (s *WorkerSuite) TestShutdownProgress(c *C) {
+	w := NewWorkerConfig()
+	w.RedisNamespace = "progress"
+	w.WorkerCount = 2
+	w.ShutdownProgressInterval = 100 * time.Millisecond
+	MaybeFail(c, w.Register(&SleepingWorker{}))
+	fetcher := make(chanFetcher, 2)
+	w.Fetcher = fetcher
+	data := json.RawMessage(`{}`)
+	for i := 0; i < 2; i++ {
+		fetcher <- &Job{Type: "SleepingWorker", Args: &data, Queue: "default", ID: strconv.Itoa(i)}
+	}
+
+	go w.Run()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-sleepingStarted:
+		case <-time.After(time.Second):
+			c.Fatal("assertion timeout")
+		}
+	}
+	output := captureLog(w.Shutdown)
+	if n := strings.Count(output, "state=stopping running=2"); n < 2 {
+		c.Fatalf("Expected progress to be logged every 100ms of a 300ms drain, got %d logs", n)
+	}
+}
+
+func (s *WorkerSuite) TestWorkerIDFunc(c *C) {
+	w := NewWorkerConfig()
+	w.RedisNamespace = "workerid"
+	w.WorkerCount = 1
+	w.WorkerIDFunc = func(i int) string { return "us-east-1:web:" + strconv.Itoa(i) }
+	MaybeFail(c, w.Register(&SleepingWorker{}))
+	fetcher := make(chanFetcher, 1)
+	w.Fetcher = fetcher
+	data := json.RawMessage(`{}`)
+	fetcher <- &Job{Type: "SleepingWorker", Args: &data, Queue: "default", ID: "123"}
+
+	go w.Run()
+	select {
+	case <-sleepingStarted:
+	case <-time.After(time.Second):
+		c.Fatal("assertion timeout")
+	}
+	isMember, err := redis.Bool(w.redisQuery("SISMEMBER", "workerid:workers", "us-east-1:web:0"))
+	MaybeFail(c, err)
+	c.Assert(isMember, Equals, true)
+	exists, err := redis.Bool(w.redisQuery("EXISTS", "workerid:worker:us-east-1:web:0"))
+	MaybeFail(c, err)
+	c.Assert(exists, Equals, true)
+
+	w.Shutdown()
+	isMember, err = redis.Bool(w.redisQuery("SISMEMBER", "workerid:workers", "us-east-1:web:0"))
+	MaybeFail(c, err)
+	c.Assert(isMember, Equals, false)
+}
+
+func (s *WorkerSuite) TestRunWorkersAndScheduler(c *C) {
+	scheduler := NewWorkerConfig(WithNamespace("split"), WithPollInterval(10*time.Millisecond))
+	workers := NewWorkerConfig(WithNamespace("split"), WithPollInterval(10*time.Millisecond))
+	MaybeFail(c, workers.Register(&ContextFieldWorker{}))
+	_, err := workers.redisQuery("DEL", "split:queue:default", "split:schedule")
+	MaybeFail(c, err)
+	data := json.RawMessage(`{}`)
+	job := &Job{Type: "ContextFieldWorker", Args: &data, Queue: "default", ID: "123"}
+
+	// the workers leave due jobs in the schedule set
+	go workers.RunWorkers()
+	defer workers.Shutdown()
+	<-workers.Ready()
+	_, err = workers.redisQuery("ZADD", "split:schedule", 0, job.JSON())
+	MaybeFail(c, err)
+	time.Sleep(50 * time.Millisecond)
+	scheduled, err := redis.Int(workers.redisQuery("ZCARD", "split:schedule"))
+	MaybeFail(c, err)
+	c.Assert(scheduled, Equals, 1)
+
+	// the scheduler promotes them for the workers to perform
+	go scheduler.RunScheduler()
+	defer scheduler.Shutdown()
+	select {
+	case <-contextChan:
+	case <-time.After(time.Second):
+		c.Fatal("the scheduled job wasn't performed")
+	}
+}
+
+func (s *WorkerSuite) TestRunScheduler(c *C) {
+	scheduler := NewWorkerConfig(WithNamespace("scheduler"), WithPollInterval(10*time.Millisecond))
+	MaybeFail(c, scheduler.Register(&ContextFieldWorker{}))
+	_, err := scheduler.redisQuery("DEL", "scheduler:queue:default")
+	MaybeFail(c, err)
+	data := json.RawMessage(`{}`)
+	job := &Job{Type: "ContextFieldWorker", Args: &data, Queue: "default", ID: "123"}
+	_, err = scheduler.redisQuery("ZADD", "scheduler:schedule", 0, job.JSON())
+	MaybeFail(c, err)
+
+	go scheduler.RunScheduler()
+	<-scheduler.Ready()
+	time.Sleep(50 * time.Millisecond)
+	scheduler.Shutdown()
+	queued, err := redis.Int(scheduler.redisQuery("LLEN", "scheduler:queue:default"))
+	MaybeFail(c, err)
+	c.Assert(queued, Equals, 1) // promoted, but not performed
+}
+
+type argsContextWorker struct{ args chan []interface{} }
+
+func (w argsContextWorker) Perform(ctx context.Context, args []interface{}) error {
+	w.args <- args
+	if len(args) > 0 && args[0] == "block" {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (s *WorkerSuite) TestRegisterContext(c *C) {
+	w := NewWorkerConfig()
+	w.JobTimeout = 20 * time.Millisecond
+	worker := argsContextWorker{make(chan []interface{}, 1)}
+	MaybeFail(c, w.RegisterContext("ContextWorker", worker))
+	c.Assert(w.RegisterContext("Nil", nil), Equals, ErrNilWorker)
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	perform := func(args string) []interface{} {
+		data := json.RawMessage(args)
+		w.process(&Job{Type: "ContextWorker", Args: &data, Queue: "default", ID: "1", MaxRetries: 25}, "test")
+		return <-worker.args
+	}
+	c.Assert(perform(`["bob",5]`), DeepEquals, []interface{}{"bob", float64(5)})
+	c.Assert(perform(`{"name":"bob"}`), DeepEquals, []interface{}{map[string]interface{}{"name": "bob"}})
+	c.Assert(perform(`[]`), DeepEquals, []interface{}{})
+
+	// the context expires after JobTimeout and the job is retried
+	c.Assert(perform(`["block"]`), DeepEquals, []interface{}{"block"})
+	retries, err := redis.ByteSlices(w.redisQuery("ZRANGE", "retry", 0, -1))
+	MaybeFail(c, err)
+	c.Assert(retries, HasLen, 1)
+	job := &Job{}
+	MaybeFail(c, job.FromJSON(retries[0]))
+	c.Assert(job.ErrorMessage, Equals, "gokiq: Job of type ContextWorker timed out after 20ms: context deadline exceeded")
+}
+
+type SlowWorker struct {
+	Ctx context.Context
+}
+
+func (w *SlowWorker) Perform() error {
+	<-w.Ctx.Done() // a call that gives up when the context expires
+	return w.Ctx.Err()
+}
+
+func (s *WorkerSuite) TestJobTimeouts(c *C) {
+	w := NewWorkerConfig()
+	w.JobTimeout = time.Minute
+	w.JobTimeouts = map[string]time.Duration{"SlowWorker": 10 * time.Millisecond, "Unlimited": -1}
+	MaybeFail(c, w.Register(&SlowWorker{}))
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+	c.Assert(w.jobTimeout("Unlimited"), Equals, time.Duration(0))
+	c.Assert(w.jobTimeout("Other"), Equals, time.Minute)
+
+	data := json.RawMessage(`{}`)
+	start := time.Now()
+	w.process(&Job{Type: "SlowWorker", Args: &data, Queue: "default", ID: "1", MaxRetries: 25}, "test")
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond || elapsed > time.Second {
+		c.Fatalf("Expected the job to stop when its context expired, it took %s", elapsed)
+	}
+
+	retries, err := redis.ByteSlices(w.redisQuery("ZRANGE", "retry", 0, -1))
+	MaybeFail(c, err)
+	c.Assert(retries, HasLen, 1)
+	job := &Job{}
+	MaybeFail(c, job.FromJSON(retries[0]))
+	c.Assert(job.ErrorType, Equals, "gokiq.JobTimeoutError")
+	c.Assert(job.ErrorMessage, Equals, "gokiq: Job of type SlowWorker timed out after 10ms: context deadline exceeded")
+}
+
+// ignores its context and succeeds once it is done
+type StubbornWorker struct{}
+
+func (w *StubbornWorker) Perform() error {
+	time.Sleep(30 * time.Millisecond)
+	return nil
+}
+
+func (s *WorkerSuite) TestJobTimeoutIgnored(c *C) {
+	w := NewWorkerConfig()
+	w.JobTimeout = 10 * time.Millisecond
+	MaybeFail(c, w.Register(&StubbornWorker{}))
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	data := json.RawMessage(`{}`)
+	log := captureLog(func() {
+		w.process(&Job{Type: "StubbornWorker", Args: &data, Queue: "default", ID: "1", MaxRetries: 25}, "test")
+	})
+	c.Assert(log, Matches, "(?s).*event=job_timeout job_id=1 job_type=StubbornWorker.*")
+
+	retries, err := redis.ByteSlices(w.redisQuery("ZRANGE", "retry", 0, -1))
+	MaybeFail(c, err)
+	c.Assert(retries, HasLen, 1)
+	job := &Job{}
+	MaybeFail(c, job.FromJSON(retries[0]))
+	c.Assert(job.ErrorType, Equals, "gokiq.JobTimeoutError")
+	c.Assert(job.ErrorMessage, Equals, "gokiq: Job of type StubbornWorker timed out after 10ms: context deadline exceeded")
+	failed, err := redis.Int(w.redisQuery("GET", "stat:failed"))
+	MaybeFail(c, err)
+	c.Assert(failed, Equals, 1)
+}
+
+func (s *WorkerSuite) TestJobDeadline(c *C) {
+	w := NewWorkerConfig()
+	w.JobTimeout = time.Minute
+	MaybeFail(c, w.Register(&ContextFieldWorker{}))
+
+	data := json.RawMessage(`{}`)
+	job := &Job{Type: "ContextFieldWorker", Args: &data, Queue: "default", ID: "123"}
+	start := time.Now()
+	w.process(job, "test")
+
+	ctx := <-contextChan
+	deadline, ok := ctx.Deadline()
+	c.Assert(ok, Equals, true)
+	if deadline.Before(start.Add(w.JobTimeout)) || deadline.After(time.Now().Add(w.JobTimeout)) {
+		c.Fatalf("Expected deadline %s to be %s after the job started at %s", deadline, w.JobTimeout, start)
+	}
+	c.Assert(ctx.Err(), Equals, context.Canceled)
+}
+
+type staticFetcher struct{ job *Job }
+
+func (f staticFetcher) Fetch(ctx context.Context) (*Job, error) { return f.job, nil }
+
+func (s *WorkerSuite) TestCustomFetcher(c *C) {
+	w := NewWorkerConfig()
+	job := &Job{Type: "TestWorker", Queue: "custom", ID: "123"}
+	w.Fetcher = staticFetcher{job}
+
+	go w.run()
+
+	select {
+	case msg := <-w.workQueue:
+		c.Assert(msg.job, Equals, job)
+	case <-time.After(time.Second):
+		c.Error("assertion timeout")
+	}
+}
+
+func (s *WorkerSuite) TestStrictFetcher(c *C) {
+	w := NewWorkerConfig()
+	w.Queues = QueueConfig{"low": 1, "high": 5}
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	for _, queue := range []string{"low", "high"} {
+		job := &Job{Type: "TestWorker", ID: queue}
+		_, err = w.redisQuery("RPUSH", "queue:"+queue, job.JSON())
+		MaybeFail(c, err)
+	}
+
+	fetcher := StrictFetcher(w)
+	for _, queue := range []string{"high", "low"} {
+		job, err := fetcher.Fetch(context.Background())
+		MaybeFail(c, err)
+		c.Assert(job.Queue, Equals, queue)
+	}
+}
+
+type AtMostOnceTestWorker struct{}
+
+func (w *AtMostOnceTestWorker) Perform() error   { return errors.New("failed") }
+func (w *AtMostOnceTestWorker) AtMostOnce() bool { return true }
+
+func (s *WorkerSuite) TestAtMostOnceNotRetried(c *C) {
+	w := NewWorkerConfig()
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+	MaybeFail(c, w.Register(&AtMostOnceTestWorker{}))
+	w.denormalizeQueues()
+
+	job := &Job{}
+	MaybeFail(c, job.FromJSON([]byte(`{"class":"AtMostOnceTestWorker","args":{},"jid":"123","retry":true}`)))
+	_, err = w.redisQuery("RPUSH", "queue:default", job.JSON())
+	MaybeFail(c, err)
+	job, err = w.Fetcher.Fetch(context.Background())
+	MaybeFail(c, err)
+	w.process(job, "test")
+
+	for _, key := range []string{"queue:default", "retry"} {
+		exists, err := redis.Bool(w.redisQuery("EXISTS", key))
+		MaybeFail(c, err)
+		c.Assert(exists, Equals, false)
+	}
+	failed, err := redis.Int(w.redisQuery("GET", "stat:failed"))
+	MaybeFail(c, err)
+	c.Assert(failed, Equals, 1)
+}
+
+func (s *WorkerSuite) TestBusyJobs(c *C) {
+	w := NewWorkerConfig()
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	job := &Job{Type: "TestWorker", Queue: "default", ID: "123", Retry: true}
+	w.trackJobStart(job, "busy")
+
+	jobs, err := w.BusyJobs()
+	MaybeFail(c, err)
+	c.Assert(jobs, HasLen, 1)
+	c.Assert(jobs["busy"].Queue, Equals, "default")
+	c.Assert(jobs["busy"].Job.ID, Equals, "123")
+	c.Assert(jobs["busy"].Job.Type, Equals, "TestWorker")
+	c.Assert(jobs["busy"].Timestamp, Not(Equals), int64(0))
+
+	w.trackJobFinish(job, "busy", true)
+	jobs, err = w.BusyJobs()
+	MaybeFail(c, err)
+	c.Assert(jobs, HasLen, 0)
+}
+
+func (s *WorkerSuite) TestScheduleSubSecond(c *C) {
+	w := NewWorkerConfig()
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	config := JobConfig{Name: "TestWorker", Queue: "default", At: time.Now().Add(200 * time.Millisecond)}
+	MaybeFail(c, Client.QueueJobConfig(&TestWorker{Data: []string{"foo"}}, config))
+
+	w.PromoteDue()
+	queued, err := redis.Int(w.redisQuery("LLEN", "queue:default"))
+	MaybeFail(c, err)
+	c.Assert(queued, Equals, 0)
+
+	time.Sleep(time.Until(config.At))
+	w.PromoteDue()
+	queued, err = redis.Int(w.redisQuery("LLEN", "queue:default"))
+	MaybeFail(c, err)
+	c.Assert(queued, Equals, 1)
+}
+
+func (s *WorkerSuite) TestStrictRegistration(c *C) {
+	w := NewWorkerConfig()
+	w.StrictRegistration = true
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	data := json.RawMessage(`[]`)
+	w.process(&Job{Type: "Unregistered", Args: &data, Queue: "default", ID: "123", MaxRetries: 25}, "test")
+
+	retries, err := redis.Int(w.redisQuery("ZCARD", "retry"))
+	MaybeFail(c, err)
+	c.Assert(retries, Equals, 0)
+	dead, err := redis.Values(w.redisQuery("ZRANGE", "dead", 0, -1))
+	MaybeFail(c, err)
+	c.Assert(dead, HasLen, 1)
+	job := &Job{}
+	MaybeFail(c, job.FromJSON(dead[0].([]byte)))
+	c.Assert(job.ErrorType, Equals, "gokiq.UnknownWorkerError")
+}
+
+func (s *WorkerSuite) TestMissingClass(c *C) {
+	w := NewWorkerConfig()
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	job := &Job{}
+	MaybeFail(c, job.FromJSON([]byte(`{"args":[],"queue":"default","jid":"123","retry":true}`)))
+	output := captureLog(func() { w.process(job, "test") })
+	c.Assert(strings.Contains(output, "event=missing_class job_id=123"), Equals, true)
+
+	retries, err := redis.Int(w.redisQuery("ZCARD", "retry"))
+	MaybeFail(c, err)
+	c.Assert(retries, Equals, 0)
+	dead, err := redis.Values(w.redisQuery("ZRANGE", "dead", 0, -1))
+	MaybeFail(c, err)
+	c.Assert(dead, HasLen, 1)
+	MaybeFail(c, job.FromJSON(dead[0].([]byte)))
+	c.Assert(job.ErrorMessage, Equals, ErrMissingClass.Error())
+}
+
+func (s *WorkerSuite) TestOnBeforeRetry(c *C) {
+	w := NewWorkerConfig()
+	w.OnBeforeRetry = func(job *Job, err error) *Job {
+		args := json.RawMessage(fmt.Sprintf(`{"args":["bar"],"last_error":%q}`, err))
+		job.Args = &args
+		return job
+	}
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	data := json.RawMessage(`{"args":["bar"]}`)
+	w.scheduleRetry(&Job{Type: "TestWorker", Args: &data, Queue: "default", ID: "123", MaxRetries: 25}, errors.New("timed out"), false)
+
+	retries, err := redis.Values(w.redisQuery("ZRANGE", "retry", 0, -1))
+	MaybeFail(c, err)
+	c.Assert(retries, HasLen, 1)
+	job := &Job{}
+	MaybeFail(c, job.FromJSON(retries[0].([]byte)))
+	c.Assert(string(*job.Args), Equals, `{"args":["bar"],"last_error":"timed out"}`)
+}
+
+var numberChan = make(chan interface{}, 1)
+
+type NumberWorker struct {
+	Args []interface{} `json:"args"`
+}
+
+func (w *NumberWorker) Perform() error {
+	numberChan <- w.Args[0]
+	return nil
+}
+
+func (s *WorkerSuite) TestUseNumber(c *C) {
+	w := NewWorkerConfig()
+	w.UseNumber = true
+	MaybeFail(c, w.Register(&NumberWorker{}))
+
+	id := int64(1)<<53 + 1
+	data := json.RawMessage(fmt.Sprintf(`{"args":[%d]}`, id))
+	w.process(&Job{Type: "NumberWorker", Args: &data, Queue: "default", ID: "123"}, "test")
+	arg := <-numberChan
+	c.Assert(arg, FitsTypeOf, json.Number(""))
+	n, err := ArgInt64(arg)
+	MaybeFail(c, err)
+	c.Assert(n, Equals, id)
+
+	// float64 args lose the last bit
+	w.UseNumber = false
+	w.process(&Job{Type: "NumberWorker", Args: &data, Queue: "default", ID: "123"}, "test")
+	n, err = ArgInt64(<-numberChan)
+	MaybeFail(c, err)
+	c.Assert(n, Not(Equals), id)
+
+	_, err = ArgInt64("1")
+	c.Assert(err, NotNil)
+}
+
+func (s *WorkerSuite) TestRegisterWhileProcessing(c *C) {
+	w := NewWorkerConfig()
+	MaybeFail(c, w.Register(&TestWorker{}))
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 50; i++ {
+			data := json.RawMessage(`{"args":["bar"]}`)
+			w.process(&Job{Type: "TestWorker", Args: &data, Queue: "default", ID: strconv.Itoa(i)}, "test")
+		}
+		close(done)
+	}()
+	for i := 0; i < 50; i++ {
+		MaybeFail(c, w.RegisterName("TestWorker"+strconv.Itoa(i), &TestWorker{}))
+	}
+	<-done
+
+	w.mappingMtx.RLock()
+	c.Assert(w.workerMapping, HasLen, 51)
+	w.mappingMtx.RUnlock()
+}
+
+func (s *WorkerSuite) TestFailureCounters(c *C) {
+	w := NewWorkerConfig()
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	job := &Job{Type: "TestWorker", Queue: "default", ID: "123", MaxRetries: 25}
+	for i, expected := range [][2]int{{1, 0}, {1, 1}} {
+		w.scheduleRetry(job, errors.New("failed"), false)
+		counts, err := redis.Ints(w.redisQuery("MGET", "stat:first_failures", "stat:retry_failures"))
+		MaybeFail(c, err)
+		c.Assert([2]int{counts[0], counts[1]}, Equals, expected, Commentf("failure %d", i+1))
+	}
+}
+
+// a redis.Conn that answers commands with a function
+type fakeConn struct {
+	do     func(command string, args ...interface{}) (interface{}, error)
+	closed bool
+}
+
+func (f *fakeConn) Close() error                      { f.closed = true; return nil }
+func (f *fakeConn) Err() error                        { return nil }
+func (f *fakeConn) Send(string, ...interface{}) error { return nil }
+func (f *fakeConn) Flush() error                      { return nil }
+func (f *fakeConn) Receive() (interface{}, error)     { return nil, nil }
+func (f *fakeConn) Do(command string, args ...interface{}) (interface{}, error) {
+	return f.do(command, args...)
+}
+
+// fails the next failures EXECs, discarding their transactions
+type flakyConn struct {
+	redis.Conn
+	failures *int32
+}
+
+func (f flakyConn) Do(command string, args ...interface{}) (interface{}, error) {
+	if command == "EXEC" && atomic.AddInt32(f.failures, -1) >= 0 {
+		f.Conn.Do("DISCARD")
+		return nil, io.ErrUnexpectedEOF
+	}
+	return f.Conn.Do(command, args...)
+}
+
+func (s *WorkerSuite) TestTrackingRetried(c *C) {
+	w := NewWorkerConfig()
+	MaybeFail(c, w.Register(&TestWorker{}))
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+	failures := int32(0)
+	dial := w.RedisPool.Dial
+	w.RedisPool = redis.NewPool(func() (redis.Conn, error) {
+		conn, err := dial()
+		return flakyConn{conn, &failures}, err
+	}, 1)
+
+	job := &Job{Type: "TestWorker", Queue: "default", ID: "123"}
+	atomic.StoreInt32(&failures, 1)
+	w.trackJobStart(job, "flaky")
+	isMember, err := redis.Bool(w.redisQuery("SISMEMBER", "workers", "flaky"))
+	MaybeFail(c, err)
+	c.Assert(isMember, Equals, true)
+
+	atomic.StoreInt32(&failures, 2)
+	w.trackJobFinish(job, "flaky", true)
+	isMember, err = redis.Bool(w.redisQuery("SISMEMBER", "workers", "flaky"))
+	MaybeFail(c, err)
+	c.Assert(isMember, Equals, false)
+	processed, err := redis.Int(w.redisQuery("GET", "stat:processed"))
+	MaybeFail(c, err)
+	c.Assert(processed, Equals, 1)
+
+	// batched stats are only counted once however many attempts it takes
+	w.StatFlushInterval = time.Hour
+	w.trackJobStart(job, "flaky")
+	atomic.StoreInt32(&failures, 2)
+	w.trackJobFinish(job, "flaky", false)
+	w.flushStats()
+	for key, expected := range map[string]int{"stat:processed": 2, "stat:failed": 1} {
+		count, err := redis.Int(w.redisQuery("GET", key))
+		MaybeFail(c, err)
+		c.Assert(count, Equals, expected, Commentf(key))
+	}
+}
+
+func (s *WorkerSuite) TestStaleConnectionReplaced(c *C) {
+	w := NewWorkerConfig()
+	var conns []*fakeConn
+	w.RedisPool.Dial = func() (redis.Conn, error) {
+		conn := &fakeConn{do: func(string, ...interface{}) (interface{}, error) { return "PONG", nil }}
+		conns = append(conns, conn)
+		return conn, nil
+	}
+
+	MaybeFail(c, w.RedisPool.Get().Close())
+	c.Assert(conns, HasLen, 1)
+
+	// the idle connection broke while it sat in the pool
+	conns[0].do = func(string, ...interface{}) (interface{}, error) { return nil, io.EOF }
+	w.IdleCheck = time.Nanosecond
+	time.Sleep(time.Millisecond)
+
+	_, err := w.redisQuery("PING")
+	MaybeFail(c, err)
+	c.Assert(conns, HasLen, 2)
+	c.Assert(conns[0].closed, Equals, true)
+}
+
+func (s *WorkerSuite) TestDrainQueue(c *C) {
+	w := NewWorkerConfig()
+	w.Queues = QueueConfig{"a": 1, "b": 1}
+	MaybeFail(c, w.Register(&TestWorker{}))
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	data := json.RawMessage(`{"args":["bar"]}`)
+	for i, queue := range []string{"a", "b", "a"} {
+		job := &Job{Type: "TestWorker", Args: &data, ID: strconv.Itoa(i)}
+		_, err = w.redisQuery("RPUSH", "queue:"+queue, job.JSON())
+		MaybeFail(c, err)
+	}
+
+	n, err := w.DrainQueue(context.Background(), "a")
+	MaybeFail(c, err)
+	c.Assert(n, Equals, 2)
+
+	for queue, expected := range map[string]int{"a": 0, "b": 1} {
+		queued, err := redis.Int(w.redisQuery("LLEN", "queue:"+queue))
+		MaybeFail(c, err)
+		c.Assert(queued, Equals, expected)
+	}
+	processed, err := redis.Int(w.redisQuery("GET", "stat:processed"))
+	MaybeFail(c, err)
+	c.Assert(processed, Equals, 2)
+}
+
+func (s *WorkerSuite) TestDrainShortestFirst(c *C) {
+	w := NewWorkerConfig()
+	w.Queues = QueueConfig{"long": 5, "short": 1, "off": 0}
+	w.HistorySize = 10
+	w.DrainShortestFirst = true
+	MaybeFail(c, w.Register(&TestWorker{}))
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	data := json.RawMessage(`{"args":["bar"]}`)
+	for i, queue := range []string{"long", "long", "short", "long", "off"} {
+		job := &Job{Type: "TestWorker", Args: &data, ID: strconv.Itoa(i)}
+		_, err = w.redisQuery("RPUSH", "queue:"+queue, job.JSON())
+		MaybeFail(c, err)
+	}
+
+	n, err := w.DrainQueues(context.Background())
+	MaybeFail(c, err)
+	c.Assert(n, Equals, 4)
+
+	history, err := w.History()
+	MaybeFail(c, err)
+	c.Assert(history, HasLen, 4)
+	c.Assert(history[3].Queue, Equals, "short") // oldest
+	c.Assert(history[0].Queue, Equals, "long")
+}
+
+func (s *WorkerSuite) TestDrainOnShutdown(c *C) {
+	w := NewWorkerConfig()
+	w.RedisNamespace = "shutdowndrain"
+	w.WorkerCount = 1
+	w.Queues = QueueConfig{"long": 5, "short": 1}
+	w.HistorySize = 10
+	w.DrainOnShutdown = true
+	w.DrainShortestFirst = true
+	w.Fetcher = make(chanFetcher) // leave the jobs for the drain
+	MaybeFail(c, w.Register(&TestWorker{}))
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	data := json.RawMessage(`{"args":["bar"]}`)
+	for i, queue := range []string{"long", "long", "short", "long"} {
+		job := &Job{Type: "TestWorker", Args: &data, ID: strconv.Itoa(i)}
+		_, err = w.redisQuery("RPUSH", "shutdowndrain:queue:"+queue, job.JSON())
+		MaybeFail(c, err)
+	}
+
+	go w.Run()
+	<-w.Ready()
+	w.Shutdown()
+
+	for _, queue := range []string{"long", "short"} {
+		queued, err := redis.Int(w.redisQuery("LLEN", "shutdowndrain:queue:"+queue))
+		MaybeFail(c, err)
+		c.Assert(queued, Equals, 0)
+	}
+	history, err := w.History()
+	MaybeFail(c, err)
+	c.Assert(history, HasLen, 4)
+	c.Assert(history[3].Queue, Equals, "short") // oldest
+}
+
+func (s *WorkerSuite) TestFailureTimestamps(c *C) {
+	w := NewWorkerConfig()
+	for _, float := range []bool{false, true} {
+		_, err := w.redisQuery("FLUSHDB")
+		MaybeFail(c, err)
+		w.FloatTimestamps = float
+
+		job := &Job{Type: "TestWorker", Queue: "default", ID: "123", MaxRetries: 25}
+		for i := 0; i < 2; i++ {
+			w.scheduleRetry(job, errors.New("failed"), false)
+			retries, err := redis.Values(w.redisQuery("ZRANGE", "retry", 0, -1))
+			MaybeFail(c, err)
+			_, err = w.redisQuery("DEL", "retry")
+			MaybeFail(c, err)
+
+			job = &Job{}
+			MaybeFail(c, job.FromJSON(retries[0].([]byte)))
+			c.Assert(job.RetryCount, Equals, i)
+			var msg map[string]interface{}
+			MaybeFail(c, json.Unmarshal(retries[0].([]byte), &msg))
+			if float {
+				c.Assert(job.FailedAt, Equals, "")
+				c.Assert(job.FailedAtFloat, Not(Equals), float64(0))
+				c.Assert(msg["failed_at"], Equals, job.FailedAtFloat)
+			} else {
+				_, err = time.Parse(TimestampFormat, job.FailedAt)
+				MaybeFail(c, err)
+				c.Assert(job.FailedAtFloat, Equals, float64(0))
+				c.Assert(msg["failed_at"], Equals, job.FailedAt)
+			}
+			if i > 0 {
+				c.Assert(job.RetriedAt == "", Equals, float)
+				c.Assert(job.RetriedAtFloat == 0, Equals, !float)
+			}
+		}
+	}
+}
+
+func (s *WorkerSuite) TestSchedulerPool(c *C) {
+	w := NewWorkerConfig()
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+	job := &Job{Type: "TestWorker", Queue: "default", ID: "123"}
+	_, err = w.redisQuery("ZADD", "schedule", timeFloat(time.Now()), job.JSON())
+	MaybeFail(c, err)
+
+	// every connection in the worker pool is busy
+	w.RedisPool.MaxActive = 1
+	conn := w.RedisPool.Get()
+	defer conn.Close()
+
+	w.PromoteDue()
+	queued, err := redis.Int(conn.Do("LLEN", "queue:default"))
+	MaybeFail(c, err)
+	c.Assert(queued, Equals, 1)
+}
+
+func (s *WorkerSuite) TestRetryFront(c *C) {
+	w := NewWorkerConfig()
+	w.RetryFront = true
+	w.denormalizeQueues()
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+	fresh := &Job{Type: "TestWorker", Queue: "default", ID: "fresh"}
+	_, err = w.redisQuery("RPUSH", "queue:default", fresh.JSON())
+	MaybeFail(c, err)
+	retry := &Job{Type: "TestWorker", Queue: "default", ID: "retry"}
+	_, err = w.redisQuery("ZADD", "retry", timeFloat(time.Now()), retry.JSON())
+	MaybeFail(c, err)
+
+	w.PromoteDue()
+	for _, id := range []string{"retry", "fresh"} {
+		job, err := w.Fetcher.Fetch(context.Background())
+		MaybeFail(c, err)
+		c.Assert(job.ID, Equals, id)
+	}
+}
+
+type ResetWorker struct {
+	Name   string
+	Emails []string
+	resets int
+}
+
+var resetChan = make(chan []string, 1)
+
+func (w *ResetWorker) Perform() error {
+	resetChan <- w.Emails
+	return nil
+}
+
+func (w *ResetWorker) Reset() {
+	w.Name, w.Emails = "", nil
+	w.resets++
+}
+
+type LargeWorker struct {
+	ID     int
+	Buffer [64 << 10]byte
+}
+
+func (w *LargeWorker) Perform() error { return nil }
+
+func (s *WorkerSuite) TestReuseWorkers(c *C) {
+	w := NewWorkerConfig()
+	w.ReuseWorkers = true
+	MaybeFail(c, w.Register(&ResetWorker{}))
+	w.mappingMtx.RLock()
+	pool := w.workerPools["ResetWorker"]
+	typ := w.workerMapping["ResetWorker"]
+	w.mappingMtx.RUnlock()
+
+	worker := w.newWorker(typ, pool).(*ResetWorker)
+	worker.Name, worker.Emails = "first", []string{"a@example.com"}
+	w.releaseWorker(worker, pool)
+	c.Assert(worker.resets, Equals, 1)
+	c.Assert(worker.Name, Equals, "")
+	c.Assert(worker.Emails, IsNil)
+
+	// workers without Reset are zeroed
+	MaybeFail(c, w.Register(&LargeWorker{}))
+	large := &LargeWorker{ID: 5}
+	w.releaseWorker(large, w.workerPools["LargeWorker"])
+	c.Assert(large.ID, Equals, 0)
+
+	data := json.RawMessage(`{"Name":"second"}`)
+	go w.process(&Job{Type: "ResetWorker", Args: &data, Queue: "default", ID: "123"}, "reuse")
+	select {
+	case emails := <-resetChan:
+		c.Assert(emails, IsNil)
+	case <-time.After(time.Second):
+		c.Error("assertion timeout")
+	}
+}
+
+// a worker whose methods have value receivers
+type ValueWorker struct {
+	Name string
+}
+
+var valueChan = make(chan string, 1)
+
+func (w ValueWorker) Perform() error {
+	valueChan <- w.Name
+	return nil
+}
+
+func (w ValueWorker) Reset() {}
+
+func (s *WorkerSuite) TestWorkerReceivers(c *C) {
+	w := NewWorkerConfig()
+	w.ReuseWorkers = true
+	MaybeFail(c, w.Register(ValueWorker{}))
+	MaybeFail(c, w.RegisterName("ValueWorkerPtr", &ValueWorker{}))
+	MaybeFail(c, w.Register(&TestWorker{}))
+	c.Assert(w.workerMapping["ValueWorker"], Equals, reflect.TypeOf(ValueWorker{}))
+	c.Assert(w.workerMapping["ValueWorkerPtr"], Equals, reflect.TypeOf(ValueWorker{}))
+	c.Assert(w.workerMapping["TestWorker"], Equals, reflect.TypeOf(TestWorker{}))
+
+	// a pointer to a pointer can't be instantiated as a Worker
+	err := w.registerType("TestWorkerPtr", reflect.TypeOf(&TestWorker{}))
+	c.Assert(err, FitsTypeOf, InvalidWorkerError{})
+
+	for _, class := range []string{"ValueWorker", "ValueWorkerPtr"} {
+		data := json.RawMessage(`{"Name":"value"}`)
+		w.process(&Job{Type: class, Args: &data, Queue: "default", ID: "123"}, "test")
+		c.Assert(<-valueChan, Equals, "value")
+	}
+
+	// a Reset with a value receiver can't clear the worker, so it is zeroed
+	pool := w.workerPools["ValueWorker"]
+	worker := w.newWorker(w.workerMapping["ValueWorker"], pool).(*ValueWorker)
+	worker.Name = "stale"
+	w.releaseWorker(worker, pool)
+	c.Assert(worker.Name, Equals, "")
+}
+
+func benchmarkNewWorker(c *C, reuse bool) {
+	w := NewWorkerConfig()
+	w.ReuseWorkers = reuse
+	MaybeFail(c, w.Register(&LargeWorker{}))
+	pool := w.workerPools["LargeWorker"]
+	typ := w.workerMapping["LargeWorker"]
+	data := []byte(`{"ID":1}`)
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		worker := w.newWorker(typ, pool)
+		json.Unmarshal(data, worker)
+		w.releaseWorker(worker, pool)
+	}
+}
+
+func (s *WorkerSuite) BenchmarkNewWorker(c *C)    { benchmarkNewWorker(c, false) }
+func (s *WorkerSuite) BenchmarkReuseWorkers(c *C) { benchmarkNewWorker(c, true) }
+
+func (s *WorkerSuite) TestClassStats(c *C) {
+	w := NewWorkerConfig()
+	w.TrackClassStats = true
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	for _, d := range []time.Duration{time.Second, 3 * time.Second, 2 * time.Second} {
+		w.trackJobFinish(&Job{Type: "TestWorker", Queue: "default", ID: "123", StartTime: time.Now().Add(-d)}, "stats", true)
+	}
+
+	summary, err := w.ClassStats("TestWorker")
+	MaybeFail(c, err)
+	c.Assert(summary.Count, Equals, 3)
+	if summary.Max < 3*time.Second || summary.Max > 3*time.Second+100*time.Millisecond {
+		c.Fatalf("Expected a max of about 3s, got %s", summary.Max)
+	}
+	if mean := summary.Mean(); mean < 2*time.Second || mean > 2*time.Second+100*time.Millisecond {
+		c.Fatalf("Expected a mean of about 2s, got %s", mean)
+	}
+	keys, err := redis.Strings(w.redisQuery("KEYS", "stat:class:TestWorker:*"))
+	MaybeFail(c, err)
+	c.Assert(len(keys) > 0, Equals, true)
+	ttl, err := redis.Int(w.redisQuery("TTL", keys[0]))
+	MaybeFail(c, err)
+	c.Assert(ttl > 0, Equals, true)
+
+	// runs older than ClassStatsTTL aren't counted
+	w.ClassStatsTTL = 240 * time.Millisecond
+	w.trackJobFinish(&Job{Type: "Windowed", Queue: "default", ID: "1", StartTime: time.Now()}, "stats", true)
+	summary, err = w.ClassStats("Windowed")
+	MaybeFail(c, err)
+	c.Assert(summary.Count, Equals, 1)
+	time.Sleep(300 * time.Millisecond)
+	w.trackJobFinish(&Job{Type: "Windowed", Queue: "default", ID: "2", StartTime: time.Now()}, "stats", true)
+	summary, err = w.ClassStats("Windowed")
+	MaybeFail(c, err)
+	c.Assert(summary.Count, Equals, 1)
+
+	summary, err = w.ClassStats("Unknown")
+	MaybeFail(c, err)
+	c.Assert(summary, Equals, ClassSummary{})
+}
+
+func (s *WorkerSuite) TestRate(c *C) {
+	w := NewWorkerConfig()
+	w.RateWindow = 10 * time.Second
+	now := time.Unix(1000, 0)
+	c.Assert(w.rate(now), Equals, 0.0)
+
+	for i := 19; i >= 0; i-- {
+		w.recordFinish(now.Add(-time.Duration(i) * time.Second))
+	}
+	w.recordFinish(now)
+	w.recordFinish(now.Add(-time.Hour)) // too old for the window
+	// only the finishes from the last 10 seconds count
+	c.Assert(w.rate(now), Equals, 1.1)
+	c.Assert(w.rate(now.Add(5*time.Second)), Equals, 0.6)
+	c.Assert(w.rate(now.Add(time.Minute)), Equals, 0.0)
+}
+
+func (s *WorkerSuite) TestConcurrentPromotion(c *C) {
+	w := NewWorkerConfig()
+	w.ConcurrentPromotion = true
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+	now := timeFloat(time.Now())
+	for i := 0; i < 500; i++ {
+		job := &Job{Type: "TestWorker", Queue: "retried", ID: strconv.Itoa(i)}
+		_, err = w.redisQuery("ZADD", "retry", now, job.JSON())
+		MaybeFail(c, err)
+		job.Queue = "scheduled"
+		_, err = w.redisQuery("ZADD", "schedule", now, job.JSON())
+		MaybeFail(c, err)
+	}
+
+	w.PromoteDue()
+	for _, queue := range []string{"retried", "scheduled"} {
+		queued, err := redis.Int(w.redisQuery("LLEN", "queue:"+queue))
+		MaybeFail(c, err)
+		c.Assert(queued, Equals, 500)
+	}
+	for _, set := range []string{"retry", "schedule"} {
+		left, err := redis.Int(w.redisQuery("ZCARD", set))
+		MaybeFail(c, err)
+		c.Assert(left, Equals, 0)
+	}
+}
+
+func (s *WorkerSuite) TestRetryBacklogWarning(c *C) {
+	w := NewWorkerConfig()
+	w.RetryWarnThreshold = 3
+	var sizes []int
+	w.OnRetryBacklog = func(size int) { sizes = append(sizes, size) }
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	at := timeFloat(time.Now().Add(time.Hour))
+	for i := 0; i < 5; i++ {
+		job := &Job{Type: "TestWorker", Queue: "default", ID: strconv.Itoa(i)}
+		w.checkRetryBacklog()
+		_, err = w.redisQuery("ZADD", "retry", at, job.JSON())
+		MaybeFail(c, err)
+	}
+	output := captureLog(w.checkRetryBacklog)
+
+	c.Assert(sizes, DeepEquals, []int{4, 5})
+	c.Assert(strings.Contains(output, "event=retry_backlog size=5 threshold=3"), Equals, true)
+}
+
+var goroutineChan = make(chan string, 1)
+
+type GoroutineWorker struct{ Depth int }
+
+func (w *GoroutineWorker) Perform() error {
+	recurse(w.Depth)
+	buf := make([]byte, 64)
+	goroutineChan <- strings.Fields(string(buf[:runtime.Stack(buf, false)]))[1]
+	return nil
+}
+
+func recurse(depth int) int {
+	var pad [1024]byte
+	if depth <= 0 {
+		return int(pad[0])
+	}
+	return recurse(depth-1) + int(pad[depth%len(pad)])
+}
+
+func (s *WorkerSuite) TestIsolatePerform(c *C) {
+	w := NewWorkerConfig()
+	w.IsolatePerform = true
+	MaybeFail(c, w.Register(&GoroutineWorker{}))
+
+	// a job that grows its stack shouldn't leave the next one with it
+	goroutines := make(map[string]bool)
+	for _, args := range []string{`{"Depth":1000}`, `{"Depth":0}`} {
+		data := json.RawMessage(args)
+		w.process(&Job{Type: "GoroutineWorker", Args: &data, Queue: "default", ID: "123"}, "isolated")
+		goroutines[<-goroutineChan] = true
+	}
+	c.Assert(goroutines, HasLen, 2)
+}
+
+func benchmarkRunPerform(c *C, isolate bool) {
+	w := NewWorkerConfig()
+	w.IsolatePerform = isolate
+	for i := 0; i < c.N; i++ {
+		w.runPerform(func() {})
+	}
+}
+
+func (s *WorkerSuite) BenchmarkRunPerform(c *C)         { benchmarkRunPerform(c, false) }
+func (s *WorkerSuite) BenchmarkRunPerformIsolated(c *C) { benchmarkRunPerform(c, true) }
+
+func (s *WorkerSuite) TestConfigJSON(c *C) {
+	w := NewWorkerConfig()
+	w.Queues = QueueConfig{"critical": 5, "default": 1}
+	w.RedisServer = "redis://:hunter2@127.0.0.1:6379/0"
+
+	var config map[string]interface{}
+	MaybeFail(c, json.Unmarshal(w.ConfigJSON(), &config))
+	c.Assert(config["queues"], DeepEquals, map[string]interface{}{"critical": float64(5), "default": float64(1)})
+	c.Assert(config["redis_server"], Equals, "redis://:REDACTED@127.0.0.1:6379/0")
+	c.Assert(config["poll_interval"], Equals, "5s")
+
+	// a URL that can't be parsed doesn't give its password away either
+	w.RedisServer = "redis://:hunter2%zz@127.0.0.1:6379/0"
+	MaybeFail(c, json.Unmarshal(w.ConfigJSON(), &config))
+	c.Assert(config["redis_server"], Equals, "REDACTED@127.0.0.1:6379/0")
+	c.Assert(redactURL("127.0.0.1:6379"), Equals, "127.0.0.1:6379")
+
+	// the URL is dialed by the default pool
+	w.RedisServer = "redis://127.0.0.1:6379/0"
+	_, err := w.redisQuery("PING")
+	MaybeFail(c, err)
+}
+
+func (s *WorkerSuite) TestSchedulerTicksDontOverlap(c *C) {
+	w := NewWorkerConfig()
+	var execs int32
+	w.SchedulerPool = &redis.Pool{Dial: func() (redis.Conn, error) {
+		return &fakeConn{do: func(command string, args ...interface{}) (interface{}, error) {
+			if command != "EXEC" {
+				return nil, nil
+			}
+			atomic.AddInt32(&execs, 1)
+			time.Sleep(50 * time.Millisecond) // a big backlog
+			return []interface{}{[]interface{}{}, int64(0)}, nil
+		}}, nil
+	}}
+
+	slow := make(chan struct{})
+	go func() {
+		w.tick()
+		close(slow)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	output := captureLog(w.tick)
+	<-slow
+
+	c.Assert(strings.Contains(output, "event=scheduler_tick_skipped"), Equals, true)
+	c.Assert(atomic.LoadInt32(&execs), Equals, int32(2)) // one EXEC for each of retry and schedule
+}
+
+// replies to the next bogus EXECs with something that isn't a list of replies
+type bogusConn struct {
+	redis.Conn
+	bogus *int32
+}
+
+func (b bogusConn) Do(command string, args ...interface{}) (interface{}, error) {
+	if command == "EXEC" && atomic.AddInt32(b.bogus, -1) >= 0 {
+		b.Conn.Do("DISCARD")
+		return []interface{}{"bogus"}, nil
+	}
+	return b.Conn.Do(command, args...)
+}
+
+func (s *WorkerSuite) TestSchedulerPanic(c *C) {
+	w := NewWorkerConfig()
+	w.PollInterval = 10 * time.Millisecond
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+	job := &Job{Type: "TestWorker", Queue: "default", ID: "123"}
+	_, err = w.redisQuery("ZADD", "retry", timeFloat(time.Now()), job.JSON())
+	MaybeFail(c, err)
+	var reported error
+	w.ReportError = func(err error, job *Job) { reported = err }
+
+	bogus := int32(1)
+	w.SchedulerPool = &redis.Pool{Dial: func() (redis.Conn, error) {
+		conn, err := w.RedisPool.Dial()
+		return bogusConn{conn, &bogus}, err
+	}}
+	output := captureLog(w.tick)
+	c.Assert(strings.Contains(output, "event=scheduler_panic"), Equals, true)
+	c.Assert(reported, FitsTypeOf, &PanicError{})
+
+	go w.scheduler()
+	defer w.cancel()
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(5 * time.Millisecond) {
+		if queued, _ := redis.Int(w.redisQuery("LLEN", "queue:default")); queued == 1 {
+			return
+		}
+	}
+	c.Fatal("the job wasn't promoted after the panic")
+}
+
+func (s *WorkerSuite) TestPromoteDue(c *C) {
+	w := NewWorkerConfig()
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+	due := &Job{Type: "TestWorker", Queue: "default", ID: "due"}
+	later := &Job{Type: "TestWorker", Queue: "default", ID: "later"}
+	_, err = w.redisQuery("ZADD", "schedule", timeFloat(time.Now()), due.JSON(), timeFloat(time.Now().Add(time.Hour)), later.JSON())
+	MaybeFail(c, err)
+
+	promoted, err := w.PromoteDue()
+	MaybeFail(c, err)
+	c.Assert(promoted, Equals, 1)
+	queued, err := redis.Values(w.redisQuery("LRANGE", "queue:default", 0, -1))
+	MaybeFail(c, err)
+	c.Assert(queued, HasLen, 1)
+	MaybeFail(c, due.FromJSON(queued[0].([]byte)))
+	c.Assert(due.ID, Equals, "due")
+
+	promoted, err = w.PromoteDue()
+	MaybeFail(c, err)
+	c.Assert(promoted, Equals, 0)
+}
+
+func (s *WorkerSuite) TestJobTimestamps(c *C) {
+	w := NewWorkerConfig()
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	job := &Job{}
+	MaybeFail(c, job.FromJSON([]byte(`{"class":"TestWorker","args":[],"queue":"default","jid":"1","created_at":1700000000.5,"enqueued_at":1700000001}`)))
+	c.Assert(job.Created().Equal(time.Unix(1700000000, 5e8)), Equals, true)
+	job.StartTime = job.Enqueued().Add(2 * time.Second)
+	c.Assert(job.Latency(), Equals, 2*time.Second)
+	c.Assert((&Job{}).Latency(), Equals, time.Duration(0))
+	c.Assert((&Job{}).Created().IsZero(), Equals, true)
+
+	// retries keep them
+	job.MaxRetries = 25
+	w.scheduleRetry(job, errors.New("timeout"), false)
+	retries, err := redis.ByteSlices(w.redisQuery("ZRANGE", "retry", 0, -1))
+	MaybeFail(c, err)
+	retried := &Job{}
+	MaybeFail(c, retried.FromJSON(retries[0]))
+	c.Assert(retried.CreatedAt, Equals, 1700000000.5)
+	c.Assert(retried.EnqueuedAt, Equals, float64(1700000001))
+
+	// and the scheduler sets enqueued_at when it queues a job
+	_, err = w.redisQuery("ZADD", "schedule", 0, `{"class":"TestWorker","args":[],"queue":"default","jid":"2","created_at":1700000000,"custom":"kept"}`)
+	MaybeFail(c, err)
+	start := time.Now()
+	_, err = w.PromoteDue()
+	MaybeFail(c, err)
+	data, err := redis.Bytes(w.redisQuery("LPOP", "queue:default"))
+	MaybeFail(c, err)
+	queued := &Job{}
+	MaybeFail(c, queued.FromJSON(data))
+	c.Assert(queued.Enqueued().Before(start), Equals, false)
+	c.Assert(string(data), Matches, `.*"custom":"kept".*`)
+}
+
+func (s *WorkerSuite) TestRetryQueue(c *C) {
+	w := NewWorkerConfig()
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	job := &Job{}
+	MaybeFail(c, job.FromJSON([]byte(`{"class":"FailingWorker","args":{},"queue":"default","jid":"1","retry_queue":"slow"}`)))
+	w.scheduleRetry(job, errors.New("timeout"), false)
+	_, err = w.redisQuery("ZADD", "retry", "XX", 0, job.JSON())
+	MaybeFail(c, err)
+	promoted, err := w.PromoteDue()
+	MaybeFail(c, err)
+	c.Assert(promoted, Equals, 1)
+
+	data, err := redis.Bytes(w.redisQuery("LPOP", "queue:slow"))
+	MaybeFail(c, err)
+	retried := &Job{}
+	MaybeFail(c, retried.FromJSON(data))
+	c.Assert(retried.ID, Equals, "1")
+	c.Assert(retried.Queue, Equals, "slow")
+	c.Assert(retried.RetryQueue, Equals, "slow")
+}
+
+func (s *WorkerSuite) TestPauseScheduler(c *C) {
+	w := NewWorkerConfig()
+	w.PollInterval = 10 * time.Millisecond
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+	go w.scheduler()
+	defer w.cancel()
+
+	w.PauseScheduler()
+	job := &Job{Type: "TestWorker", Queue: "default", ID: "123"}
+	_, err = w.redisQuery("ZADD", "schedule", 0, job.JSON())
+	MaybeFail(c, err)
+	time.Sleep(50 * time.Millisecond)
+	scheduled, err := redis.Int(w.redisQuery("ZCARD", "schedule"))
+	MaybeFail(c, err)
+	c.Assert(scheduled, Equals, 1)
+
+	w.ResumeScheduler()
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(5 * time.Millisecond) {
+		if queued, _ := redis.Int(w.redisQuery("LLEN", "queue:default")); queued == 1 {
+			return
+		}
+	}
+	c.Fatal("the job wasn't promoted after resuming")
+}
+
+func (s *WorkerSuite) TestWorkerOptions(c *C) {
+	queues := QueueConfig{"critical": 5, "default": 1}
+	w := NewWorkerConfig(
+		WithRedisURL("redis://127.0.0.1:6379/0"),
+		WithNamespace("options"),
+		WithQueues(queues),
+		WithWorkerCount(4),
+		WithPollInterval(time.Second),
+		WithStopTimeout(time.Minute),
+		WithJobTimeout(time.Hour),
+	)
+
+	expected := NewWorkerConfig()
+	expected.RedisServer = "redis://127.0.0.1:6379/0"
+	expected.RedisNamespace = "options"
+	expected.Queues = queues
+	expected.WorkerCount = 4
+	expected.PollInterval = time.Second
+	expected.StopTimeout = time.Minute
+	expected.JobTimeout = time.Hour
+	c.Assert(string(w.ConfigJSON()), Equals, string(expected.ConfigJSON()))
+
+	// the default pool is sized for the configured workers and dials the URL
+	c.Assert(w.RedisPool.MaxIdle, Equals, 5)
+	_, err := w.redisQuery("PING")
+	MaybeFail(c, err)
+
+	pool := &redis.Pool{}
+	c.Assert(NewWorkerConfig(WithRedisPool(pool)).RedisPool, Equals, pool)
+}
+
+func (s *WorkerSuite) TestRetrySets(c *C) {
+	w := NewWorkerConfig()
+	w.RetrySets = map[string]string{"FailingWorker": "retry:flaky"}
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	w.scheduleRetry(&Job{Type: "FailingWorker", Queue: "default", ID: "1", MaxRetries: 25}, errors.New("failed"), false)
+	w.scheduleRetry(&Job{Type: "TestWorker", Queue: "default", ID: "2", MaxRetries: 25}, errors.New("failed"), false)
+	for set, expected := range map[string]int{"retry": 1, "retry:flaky": 1} {
+		retries, err := redis.Int(w.redisQuery("ZCARD", set))
+		MaybeFail(c, err)
+		c.Assert(retries, Equals, expected)
+	}
+
+	// make them due
+	for _, set := range []string{"retry", "retry:flaky"} {
+		_, err = w.redisQuery("ZADD", set, "XX", 0, w.retryMember(c, set))
+		MaybeFail(c, err)
+	}
+	w.PromoteDue()
+	queued, err := redis.Int(w.redisQuery("LLEN", "queue:default"))
+	MaybeFail(c, err)
+	c.Assert(queued, Equals, 2)
+}
+
+// returns the only member of a retry set
+func (w *WorkerConfig) retryMember(c *C, set string) []byte {
+	members, err := redis.ByteSlices(w.redisQuery("ZRANGE", set, 0, -1))
+	MaybeFail(c, err)
+	c.Assert(members, HasLen, 1)
+	return members[0]
+}
+
+func (s *WorkerSuite) TestBackupFile(c *C) {
+	w := NewWorkerConfig()
+	w.BackupFile = c.MkDir() + "/backup.jsonl"
+	w.RedisPool = &redis.Pool{Dial: func() (redis.Conn, error) {
+		return nil, errors.New("redis is down")
+	}}
+	w.work = map[string]*Job{
+		"a": {Type: "TestWorker", Queue: "default", ID: "1"},
+		"b": {Type: "TestWorker", Queue: "default", ID: "2"},
+		"c": {Type: "TestWorker", Queue: "critical", ID: "3"},
+		"d": {Type: "TestWorker", Queue: "default", ID: "4", AtMostOnce: true},
+	}
+	output := captureLog(w.requeueJobs)
+	c.Assert(strings.Count(output, "event=job_backup"), Equals, 2)
+
+	client := NewClientConfig()
+	_, err := NewWorkerConfig().redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+	restored, err := client.EnqueueFromFile(w.BackupFile)
+	MaybeFail(c, err)
+	c.Assert(restored, Equals, 3)
+	for queue, expected := range map[string]int{"default": 2, "critical": 1} {
+		queued, err := redis.Int(client.redisQuery("LLEN", "queue:"+queue))
+		MaybeFail(c, err)
+		c.Assert(queued, Equals, expected)
+	}
+	data, err := redis.Bytes(client.redisQuery("LPOP", "queue:critical"))
+	MaybeFail(c, err)
+	job := &Job{}
+	MaybeFail(c, job.FromJSON(data))
+	c.Assert(job.ID, Equals, "3")
+}
+
+func (s *WorkerSuite) TestQueueNameWithNamespace(c *C) {
+	w := NewWorkerConfig()
+	w.RedisNamespace = "queue:jobs:queue:"
+	long := strings.Repeat("queue:", 200)
+	w.Queues = QueueConfig{long: 1}
+	w.denormalizeQueues()
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+	job := &Job{Type: "TestWorker", ID: "123"}
+	_, err = w.redisQuery("RPUSH", "queue:jobs:queue::queue:"+long, job.JSON())
+	MaybeFail(c, err)
+
+	fetched, err := w.Fetcher.Fetch(context.Background())
+	MaybeFail(c, err)
+	c.Assert(fetched.Queue, Equals, long)
+}
+
+func (s *WorkerSuite) TestRunWithoutQueues(c *C) {
+	w := NewWorkerConfig()
+	w.Queues = QueueConfig{"default": 0, "low": 0}
+	c.Assert(w.Run(), Equals, ErrNoQueues)
+}
+
+func (s *WorkerSuite) TestParseQueues(c *C) {
+	queues, err := ParseQueues("critical,5 default")
+	MaybeFail(c, err)
+	c.Assert(queues, DeepEquals, QueueConfig{"critical": 5, "default": 1})
+
+	for _, spec := range []string{"critical,high", ",5", "low,-1"} {
+		_, err := ParseQueues(spec)
+		c.Assert(err, NotNil)
+	}
+}
+
+func (s *WorkerSuite) TestQueuesFunc(c *C) {
+	w := NewWorkerConfig(WithQueuesFunc(func() QueueConfig { return QueueConfig{"default": 0} }))
+	c.Assert(w.Run(), Equals, ErrNoQueues)
+	c.Assert(w.Queues, DeepEquals, QueueConfig{"default": 0})
+}
+
+// refuses ZADDs like a Redis server at maxmemory
+type oomConn struct {
+	redis.Conn
+	zadds *int32
+}
+
+func (o oomConn) Do(command string, args ...interface{}) (interface{}, error) {
+	if command == "ZADD" {
+		atomic.AddInt32(o.zadds, 1)
+		return nil, redis.Error("OOM command not allowed when used memory > 'maxmemory'.")
+	}
+	return o.Conn.Do(command, args...)
+}
+
+func (s *WorkerSuite) TestRetryOOM(c *C) {
+	w := NewWorkerConfig()
+	zadds := int32(0)
+	w.RedisPool = &redis.Pool{Dial: func() (redis.Conn, error) {
+		conn, err := redis.Dial("tcp", defaultRedisServer)
+		return oomConn{conn, &zadds}, err
+	}}
+	var reported error
+	w.ReportError = func(err error, job *Job) { reported = err }
+
+	job := &Job{Type: "TestWorker", Queue: "default", ID: "123", MaxRetries: 25}
+	output := captureLog(func() { w.scheduleRetry(job, errors.New("failed"), false) })
+	c.Assert(atomic.LoadInt32(&zadds), Equals, int32(oomAttempts))
+	c.Assert(strings.Contains(output, "event=retry_lost job_id=123"), Equals, true)
+	c.Assert(strings.Contains(output, "oom=true"), Equals, true)
+	c.Assert(isOOM(reported), Equals, true)
+}
+
+func (s *WorkerSuite) TestRegisterValidator(c *C) {
+	w := NewWorkerConfig()
+	MaybeFail(c, w.Register(&TestWorker{}))
+	w.RegisterValidator("TestWorker", func(args json.RawMessage) error {
+		var params struct{ Args []string }
+		if err := json.Unmarshal(args, &params); err != nil {
+			return err
+		}
+		if len(params.Args) == 0 {
+			return errors.New("args is empty")
+		}
+		return nil
+	})
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+	var reported error
+	w.ReportError = func(err error, job *Job) { reported = err }
+
+	data := json.RawMessage(`{"args":[]}`)
+	job := &Job{Type: "TestWorker", Args: &data, Queue: "default", ID: "123", MaxRetries: 25}
+	w.process(job, "test")
+	c.Assert(reported, FitsTypeOf, InvalidArgsError{})
+	dead, err := redis.Int(w.redisQuery("ZCARD", "dead"))
+	MaybeFail(c, err)
+	c.Assert(dead, Equals, 1)
+	retries, err := redis.Int(w.redisQuery("ZCARD", "retry"))
+	MaybeFail(c, err)
+	c.Assert(retries, Equals, 0)
+}
+
+func (s *WorkerSuite) TestBoostQueue(c *C) {
+	w := NewWorkerConfig()
+	w.Queues = QueueConfig{"a": 1, "b": 1}
+	w.denormalizeQueues()
+	firstA := func() int {
+		count := 0
+		for i := 0; i < 1000; i++ {
+			if w.queueList()[0] == "queue:a" {
+				count++
+			}
+		}
+		return count
+	}
+
+	c.Assert(w.BoostQueue("c", 10, time.Second), NotNil)
+	c.Assert(w.BoostQueue("a", 0, time.Second), ErrorMatches, "gokiq: Invalid boost multiplier 0")
+	c.Assert(w.BoostQueue("a", -2, time.Second), ErrorMatches, "gokiq: Invalid boost multiplier -2")
+	c.Assert(w.BoostQueue("a", 10, 0), ErrorMatches, "gokiq: Invalid boost ttl 0s")
+	c.Assert(w.BoostQueue("a", 10, -time.Second), ErrorMatches, "gokiq: Invalid boost ttl -1s")
+	c.Assert(w.boosts, HasLen, 0)
+	MaybeFail(c, w.BoostQueue("a", 10, 100*time.Millisecond))
+	if n := firstA(); n < 800 {
+		c.Fatalf("Expected the boosted queue to be first in most fetches, was in %d of 1000", n)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := firstA(); n > 700 {
+		c.Fatalf("Expected the boost to end, the queue was first in %d of 1000 fetches", n)
+	}
+}
+
+// returns everything logged while f runs
+func captureLog(f func()) string {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(ioutil.Discard)
+	f()
+	return buf.String()
+}
+
+func (s *WorkerSuite) TestCorrelationID(c *C) {
+	w := NewWorkerConfig()
+	w.CorrelationField = "trace_id"
+	MaybeFail(c, w.Register(&TestWorker{}))
+
+	for payload, id := range map[string]string{
+		`{"class":"TestWorker","args":{"args":["bar"]},"jid":"123","trace_id":"abc"}`: "abc",
+		`{"class":"TestWorker","args":{"args":["bar"]},"jid":"123"}`:                  "123",
+	} {
+		job := &Job{}
+		MaybeFail(c, job.FromJSON([]byte(payload)))
+		output := captureLog(func() { w.process(job, "test") })
+		c.Assert(strings.Count(output, " correlation_id="+id+" "), Equals, 2, Commentf("%s", output))
+	}
+}
+
+func (s *WorkerSuite) TestErrorLogSample(c *C) {
+	w := NewWorkerConfig()
+	w.ErrorLogSample = 2
+
+	job := &Job{Type: "TestWorker", Queue: "default", ID: "123", MaxRetries: 5}
+	var logged []string
+	for i := 0; i <= job.MaxRetries; i++ {
+		output := captureLog(func() { w.scheduleRetry(job, errors.New("failed"), false) })
+		if strings.Contains(output, "event=job_error") {
+			logged = append(logged, strconv.Itoa(job.RetryCount))
+		}
+	}
+	c.Assert(logged, DeepEquals, []string{"0", "2", "4", "5"})
+}
+
+func (s *WorkerSuite) TestNewJob(c *C) {
+	job := NewJob("EmailWorker", "user@example.com", 3)
+	c.Assert(job.Type, Equals, "EmailWorker")
+	c.Assert(job.Queue, Equals, "default")
+	c.Assert(job.ID, HasLen, 24)
+	c.Assert(job.Retry, Equals, true)
+	c.Assert(job.MaxRetries, Equals, defaultMaxRetries)
+	c.Assert(string(*job.Args), Equals, `["user@example.com",3]`)
+	c.Assert(NewJob("EmailWorker").ID, Not(Equals), job.ID)
+	c.Assert(string(*NewJob("EmailWorker").Args), Equals, `[]`)
+}
+
+func (s *WorkerSuite) TestRegisterNil(c *C) {
+	w := NewWorkerConfig()
+	c.Assert(w.Register(nil), Equals, ErrNilWorker)
+	c.Assert(w.Register((*TestWorker)(nil)), Equals, ErrNilWorker)
+	c.Assert(w.RegisterName("TestWorker", (*TestWorker)(nil)), Equals, ErrNilWorker)
+	c.Assert(w.workerMapping, HasLen, 0)
+
+	client := NewClientConfig()
+	c.Assert(client.Register(nil, "default", 5), Equals, ErrNilWorker)
+	c.Assert(client.Register((*TestWorker)(nil), "default", 5), Equals, ErrNilWorker)
+	c.Assert(client.jobMapping, HasLen, 0)
+}
+
+func (s *WorkerSuite) TestHistory(c *C) {
+	w := NewWorkerConfig()
+	w.HistorySize = 2
+	w.HistoryTTL = time.Hour
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	for i := 0; i < 3; i++ {
+		job := &Job{Type: "TestWorker", Queue: "default", ID: strconv.Itoa(i)}
+		w.trackJobStart(job, "test")
+		w.trackJobFinish(job, "test", i != 1)
+	}
+
+	jobs, err := w.History()
+	MaybeFail(c, err)
+	c.Assert(jobs, HasLen, 2)
+	c.Assert(jobs[0].ID, Equals, "2")
+	c.Assert(jobs[0].Success, Equals, true)
+	c.Assert(jobs[1].ID, Equals, "1")
+	c.Assert(jobs[1].Success, Equals, false)
+	c.Assert(jobs[1].Type, Equals, "TestWorker")
+
+	ttl, err := redis.Int(w.redisQuery("TTL", "history"))
+	MaybeFail(c, err)
+	c.Assert(ttl > 0 && ttl <= 3600, Equals, true)
+}
+
+type FailingWorker struct{}
+
+func (w *FailingWorker) Perform() error { return errors.New("failed") }
+
+type PanickingWorker struct{}
+
+func (w *PanickingWorker) Perform() error { panic("oops") }
+
+func (s *WorkerSuite) TestErrorBacktrace(c *C) {
+	w := NewWorkerConfig()
+	w.BacktraceLines = 3
+	MaybeFail(c, w.Register(&PanickingWorker{}))
+	MaybeFail(c, w.Register(&FailingWorker{}))
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	backtrace := func(payload string) []string {
+		_, err := w.redisQuery("DEL", "retry")
+		MaybeFail(c, err)
+		job := &Job{}
+		MaybeFail(c, job.FromJSON([]byte(payload)))
+		w.process(job, "test")
+		retries, err := redis.ByteSlices(w.redisQuery("ZRANGE", "retry", 0, -1))
+		MaybeFail(c, err)
+		c.Assert(retries, HasLen, 1)
+		retried := &Job{}
+		MaybeFail(c, retried.FromJSON(retries[0]))
+		return retried.ErrorBacktrace
+	}
+
+	lines := backtrace(`{"class":"PanickingWorker","args":{},"queue":"default","jid":"1","backtrace":true}`)
+	c.Assert(lines, HasLen, 3)
+	c.Assert(strings.Join(lines, "\n"), Matches, "(?s).*worker_test.go:[0-9]+:in `.*PanickingWorker.*")
+	c.Assert(backtrace(`{"class":"FailingWorker","args":{},"queue":"default","jid":"2","backtrace":2}`), HasLen, 2)
+	c.Assert(backtrace(`{"class":"FailingWorker","args":{},"queue":"default","jid":"3"}`), IsNil)
+}
+
+func (s *WorkerSuite) TestCircuitBreaker(c *C) {
+	w := NewWorkerConfig()
+	w.BreakerThreshold = 2
+	MaybeFail(c, w.RegisterName("Downstream", &FailingWorker{}))
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+	data := json.RawMessage(`{"args":["bar"]}`)
+	process := func(id string) {
+		w.process(&Job{Type: "Downstream", Args: &data, Queue: "default", ID: id, MaxRetries: 25}, "test")
+	}
+	count := func(set string) int {
+		n, err := redis.Int(w.redisQuery("ZCARD", set))
+		MaybeFail(c, err)
+		return n
+	}
+
+	process("1")
+	process("2")
+	output := captureLog(func() { process("3") })
+	c.Assert(strings.Contains(output, "event=job_deferred job_id=3"), Equals, true)
+	c.Assert(count("retry"), Equals, 2)
+	c.Assert(count("schedule"), Equals, 1)
+
+	// a failed probe after the cooldown opens the breaker again
+	w.breakers["Downstream"].openUntil = time.Now()
+	process("4")
+	process("5")
+	c.Assert(count("retry"), Equals, 3)
+	c.Assert(count("schedule"), Equals, 2)
+
+	// a successful one closes it
+	w.breakers["Downstream"].openUntil = time.Now()
+	MaybeFail(c, w.RegisterName("Downstream", &TestWorker{}))
+	process("6")
+	process("7")
+	c.Assert(count("schedule"), Equals, 2)
+	c.Assert(w.breakers["Downstream"], IsNil)
+}
+
+func (s *WorkerSuite) TestLastErrors(c *C) {
+	w := NewWorkerConfig()
+	w.TrackLastErrors = true
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	for i, message := range []string{"timeout", "connection refused"} {
+		job := &Job{Type: "FailingWorker", Queue: "default", ID: strconv.Itoa(i), MaxRetries: 25}
+		start := time.Now().Add(-time.Second)
+		w.scheduleRetry(job, errors.New(message), false)
+
+		errs, err := w.LastErrors()
+		MaybeFail(c, err)
+		c.Assert(errs, HasLen, 1)
+		last := errs["FailingWorker"]
+		c.Assert(last.JID, Equals, job.ID)
+		c.Assert(last.Message, Equals, message)
+		c.Assert(last.Type, Equals, "*errors.errorString")
+		c.Assert(last.At.After(start), Equals, true)
+	}
+}
+
+func (s *WorkerSuite) TestJobTags(c *C) {
+	w := NewWorkerConfig()
+	w.TrackLastErrors = true
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	job := &Job{}
+	MaybeFail(c, job.FromJSON([]byte(`{"class":"FailingWorker","args":[],"queue":"default","jid":"1","tags":["billing","eu"]}`)))
+	job.MaxRetries = 25
+	output := captureLog(func() {
+		w.trackJobStart(job, "test")
+		w.scheduleRetry(job, errors.New("timeout"), false)
+		w.trackJobFinish(job, "test", false)
+	})
+	c.Assert(strings.Count(output, " tags=billing,eu "), Equals, 3)
+
+	errs, err := w.LastErrors()
+	MaybeFail(c, err)
+	c.Assert(errs["FailingWorker"].Tags, DeepEquals, []string{"billing", "eu"})
+	retries, err := redis.ByteSlices(w.redisQuery("ZRANGE", "retry", 0, -1))
+	MaybeFail(c, err)
+	c.Assert(retries, HasLen, 1)
+	retried := &Job{}
+	MaybeFail(c, retried.FromJSON(retries[0]))
+	c.Assert(retried.Tags, DeepEquals, []string{"billing", "eu"})
+}
+
+func (s *WorkerSuite) TestStatFlushInterval(c *C) {
+	w := NewWorkerConfig()
+	w.StatFlushInterval = time.Hour
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	for i := 0; i < 5; i++ {
+		job := &Job{Type: "TestWorker", Queue: "default", ID: strconv.Itoa(i), StartTime: time.Now()}
+		w.trackJobFinish(job, "test", i < 3)
+	}
+	processed, err := redis.Int(w.redisQuery("GET", "stat:processed"))
+	c.Assert(err, Equals, redis.ErrNil)
+
+	w.flushStats()
+	w.flushStats() // nothing is counted twice
+	date := time.Now().Format(dateFormat)
+	for key, expected := range map[string]int{"stat:processed": 5, "stat:processed:" + date: 5, "stat:failed": 2, "stat:failed:" + date: 2} {
+		processed, err = redis.Int(w.redisQuery("GET", key))
+		MaybeFail(c, err)
+		c.Assert(processed, Equals, expected)
+	}
+}
+
+type EmailArgs struct {
+	Address string
+	Count   int
+	secret  string
+}
+
+func (s *WorkerSuite) TestRegisterTyped(c *C) {
+	w := NewWorkerConfig()
+	var received []EmailArgs
+	MaybeFail(c, w.RegisterTyped("EmailJob", func(args EmailArgs) error {
+		received = append(received, args)
+		return nil
+	}))
+	var tags []string
+	MaybeFail(c, w.RegisterTyped("TagJob", func(args []string) error {
+		tags = args
+		return nil
+	}))
+	c.Assert(w.RegisterTyped("BadJob", func(string) {}), NotNil)
+	c.Assert(w.RegisterTyped("NilJob", nil), NotNil)
+
+	for _, args := range []string{
+		`{"Address":"a@example.com","Count":1}`,
+		`[{"Address":"b@example.com","Count":2}]`,
+		`["c@example.com",3]`,
+	} {
+		data := json.RawMessage(args)
+		w.process(&Job{Type: "EmailJob", Args: &data, Queue: "default", ID: "123"}, "test")
+	}
+	c.Assert(received, DeepEquals, []EmailArgs{
+		{Address: "a@example.com", Count: 1},
+		{Address: "b@example.com", Count: 2},
+		{Address: "c@example.com", Count: 3},
+	})
+
+	data := json.RawMessage(`["urgent","billing"]`)
+	w.process(&Job{Type: "TagJob", Args: &data, Queue: "default", ID: "123"}, "test")
+	c.Assert(tags, DeepEquals, []string{"urgent", "billing"})
+
+	// args that don't fit the type fail the job
+	var reported error
+	w.ReportError = func(err error, job *Job) { reported = err }
+	data = json.RawMessage(`["d@example.com",4,"extra"]`)
+	w.process(&Job{Type: "EmailJob", Args: &data, Queue: "default", ID: "123", MaxRetries: 25}, "test")
+	c.Assert(reported, NotNil)
+	c.Assert(received, HasLen, 3)
+}
+
+// returns the event and jid of each entry in a stream
+func streamEvents(c *C, w *WorkerConfig, stream string) [][2]string {
+	entries, err := redis.Values(w.redisQuery("XRANGE", stream, "-", "+"))
+	MaybeFail(c, err)
+	events := make([][2]string, len(entries))
+	for i, entry := range entries {
+		fields, err := redis.StringMap(entry.([]interface{})[1], nil)
+		MaybeFail(c, err)
+		events[i] = [2]string{fields["event"], fields["jid"]}
+	}
+	return events
+}
+
+func (s *WorkerSuite) TestEventStream(c *C) {
+	w := NewWorkerConfig()
+	w.EventStream = "events"
+	MaybeFail(c, w.Register(&TestWorker{}))
+	MaybeFail(c, w.Register(&FailingWorker{}))
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	data := json.RawMessage(`{"args":["bar"]}`)
+	w.process(&Job{Type: "TestWorker", Args: &data, Queue: "default", ID: "ok", MaxRetries: 25}, "test")
+	w.process(&Job{Type: "FailingWorker", Args: &data, Queue: "default", ID: "fail", MaxRetries: 25}, "test")
+
+	c.Assert(streamEvents(c, w, "events"), DeepEquals, [][2]string{
+		{EventStarted, "ok"},
+		{EventFinished, "ok"},
+		{EventStarted, "fail"},
+		{EventFailed, "fail"},
+	})
+}
+
+func (s *WorkerSuite) TestRetriedEvent(c *C) {
+	w := NewWorkerConfig()
+	w.EventStream = "events"
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+	retried := &Job{Type: "TestWorker", Queue: "default", ID: "retried", RetryCount: 2}
+	scheduled := &Job{Type: "TestWorker", Queue: "default", ID: "scheduled"}
+	_, err = w.redisQuery("ZADD", "retry", 0, retried.JSON())
+	MaybeFail(c, err)
+	_, err = w.redisQuery("ZADD", "schedule", 0, scheduled.JSON())
+	MaybeFail(c, err)
+
+	output := captureLog(func() { w.PromoteDue() })
+	c.Assert(strings.Contains(output, "event=job_retried job_id=retried job_type=TestWorker queue=default retry_count=2 "), Equals, true)
+	c.Assert(strings.Count(output, "event=job_retried"), Equals, 1)
+	c.Assert(streamEvents(c, w, "events"), DeepEquals, [][2]string{{EventRetried, "retried"}})
+}
+
+type errorFetcher struct{}
+
+func (f errorFetcher) Fetch(ctx context.Context) (*Job, error) { return nil, errors.New("WRONGTYPE") }
+
+func (s *WorkerSuite) TestFetchErrorBackoff(c *C) {
+	w := NewWorkerConfig()
+	w.Fetcher = errorFetcher{}
+	w.ErrorBackoff = time.Millisecond
+	w.MaxFetchErrors = 3
+	var escalations []int
+	w.OnFetchErrors = func(err error, count int) { escalations = append(escalations, count) }
+
+	var delays []time.Duration
+	for i := 0; i < 6; i++ {
+		w.run()
+		delays = append(delays, w.fetchBackoff())
+	}
+	for i, delay := range delays {
+		c.Assert(delay, Equals, time.Millisecond<<uint(i))
+	}
+	c.Assert(escalations, DeepEquals, []int{3, 6})
+}
+
+func (s *WorkerSuite) TestErrorBackoffSeparateFromFetchTimeout(c *C) {
+	w := NewWorkerConfig()
+	w.Fetcher = errorFetcher{}
+	w.FetchTimeout = 5 * time.Second
+	w.ErrorBackoff = 20 * time.Millisecond
+	c.Assert(w.fetchTimeout(), Equals, 5)
+
+	start := time.Now()
+	w.run()
+	if elapsed := time.Since(start); elapsed < w.ErrorBackoff || elapsed > time.Second {
+		c.Fatalf("Expected a fetch error to back off for %s, took %s", w.ErrorBackoff, elapsed)
+	}
+
+	w.FetchTimeout = 1500 * time.Millisecond
+	c.Assert(w.fetchTimeout(), Equals, 2)
+}
+
+var (
+	orderedMtx     sync.Mutex
+	orderedRunning int
+	orderedMax     int
+	orderedSeen    []int
+	orderedDone    = make(chan struct{}, 10)
+)
+
+type OrderedWorker struct{ N int }
+
+func (w *OrderedWorker) Perform() error {
+	orderedMtx.Lock()
+	orderedRunning++
+	if orderedRunning > orderedMax {
+		orderedMax = orderedRunning
+	}
+	orderedSeen = append(orderedSeen, w.N)
+	orderedMtx.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	orderedMtx.Lock()
+	orderedRunning--
+	orderedMtx.Unlock()
+	orderedDone <- struct{}{}
+	return nil
+}
+
+func (s *WorkerSuite) TestOrderedQueues(c *C) {
+	w := NewWorkerConfig()
+	w.RedisNamespace = "ordered"
+	w.Queues = QueueConfig{"sequential": 1}
+	w.OrderedQueues = []string{"sequential"}
+	w.WorkerCount = 4
+	MaybeFail(c, w.Register(&OrderedWorker{}))
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	for i := 0; i < 6; i++ {
+		data := json.RawMessage(fmt.Sprintf(`{"N":%d}`, i))
+		job := &Job{Type: "OrderedWorker", Args: &data, ID: strconv.Itoa(i)}
+		_, err = w.redisQuery("RPUSH", "ordered:queue:sequential", job.JSON())
+		MaybeFail(c, err)
+	}
+
+	go w.Run()
+	defer w.Shutdown()
+	for i := 0; i < 6; i++ {
+		select {
+		case <-orderedDone:
+		case <-time.After(2 * time.Second):
+			c.Fatal("assertion timeout")
+		}
+	}
+
+	orderedMtx.Lock()
+	defer orderedMtx.Unlock()
+	c.Assert(orderedMax, Equals, 1)
+	c.Assert(orderedSeen, DeepEquals, []int{0, 1, 2, 3, 4, 5})
+}
+
+func (s *WorkerSuite) TestWaitEmpty(c *C) {
+	w := NewWorkerConfig()
+	w.RedisNamespace = "empty"
+	w.Queues = QueueConfig{"default": 1, "low": 1}
+	MaybeFail(c, w.Register(&TestWorker{}))
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	data := json.RawMessage(`{"args":["bar"]}`)
+	for i, queue := range []string{"default", "low", "default"} {
+		job := &Job{Type: "TestWorker", Args: &data, ID: strconv.Itoa(i)}
+		_, err = w.redisQuery("RPUSH", "empty:queue:"+queue, job.JSON())
+		MaybeFail(c, err)
+	}
+	job := &Job{Type: "TestWorker", Args: &data, Queue: "low", ID: "3"}
+	_, err = w.redisQuery("ZADD", "empty:schedule", timeFloat(time.Now()), job.JSON())
+	MaybeFail(c, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	c.Assert(w.WaitEmpty(ctx), Equals, context.DeadlineExceeded)
+	cancel()
+
+	w.PollInterval = 10 * time.Millisecond
+	go w.Run()
+	defer w.Shutdown()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	MaybeFail(c, w.WaitEmpty(ctx))
+	processed, err := redis.Int(w.redisQuery("GET", "empty:stat:processed"))
+	MaybeFail(c, err)
+	c.Assert(processed, Equals, 4)
+}
+
+func (s *WorkerSuite) TestIsEmptyChecksPriorityAndSortedQueues(c *C) {
+	w := NewWorkerConfig()
+	w.RedisNamespace = "empty"
+	w.Queues = QueueConfig{"default": 1}
+	w.PriorityQueues = []string{"urgent"}
+	w.SortedQueues = []string{"default"}
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+	empty, err := w.isEmpty()
+	MaybeFail(c, err)
+	c.Assert(empty, Equals, true)
+
+	job := &Job{Type: "TestWorker", Queue: "urgent", ID: "1"}
+	_, err = w.redisQuery("RPUSH", "empty:queue:urgent", job.JSON())
+	MaybeFail(c, err)
+	empty, err = w.isEmpty()
+	MaybeFail(c, err)
+	c.Assert(empty, Equals, false)
+
+	_, err = w.redisQuery("DEL", "empty:queue:urgent")
+	MaybeFail(c, err)
+	score, member := sortedEntry(5, time.Now(), job.JSON())
+	_, err = w.redisQuery("ZADD", "empty:sorted:default", score, member)
+	MaybeFail(c, err)
+	empty, err = w.isEmpty()
+	MaybeFail(c, err)
+	c.Assert(empty, Equals, false)
+}
+
+func (s *WorkerSuite) TestWorkerRecycle(c *C) {
+	w := NewWorkerConfig()
+	w.WorkerMaxJobs = 2
+	w.RedisNamespace = "recycle" // TestWorkerLoop's job may still be finishing
+	MaybeFail(c, w.Register(&TestWorker{}))
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+
+	output := captureLog(func() {
+		w.done.Add(1)
+		go w.worker("recycle")
+		data := json.RawMessage(`{"args":["bar"]}`)
+		for i := 0; i < 5; i++ {
+			w.workQueue <- message{job: &Job{Type: "TestWorker", Args: &data, Queue: "default", ID: strconv.Itoa(i)}}
+		}
+		close(w.workQueue)
+		w.done.Wait()
+	})
+
+	c.Assert(strings.Count(output, "event=worker_recycle"), Equals, 2)
+	processed, err := redis.Int(w.redisQuery("GET", "recycle:stat:processed"))
+	MaybeFail(c, err)
+	c.Assert(processed, Equals, 5)
+}
+
+func (s *WorkerSuite) TestWrongTypeQueueSkipped(c *C) {
+	w := NewWorkerConfig()
+	w.Queues = QueueConfig{"default": 1, "broken": 1}
+	w.SkipInvalidQueues = true
+	w.ErrorBackoff = time.Millisecond
+	w.denormalizeQueues()
+	_, err := w.redisQuery("FLUSHDB")
+	MaybeFail(c, err)
+	_, err = w.redisQuery("SET", "queue:broken", "oops")
+	MaybeFail(c, err)
+	job := &Job{Type: "TestWorker", ID: "123"}
+	_, err = w.redisQuery("RPUSH", "queue:default", job.JSON())
+	MaybeFail(c, err)
+
+	output := captureLog(func() {
+		w.checkQueueTypes([]interface{}{"queue:default", "queue:broken"})
+	})
+	c.Assert(strings.Contains(output, "event=queue_wrong_type key=queue:broken type=string skipped=true"), Equals, true)
+	c.Assert(w.queueList(), DeepEquals, []interface{}{"queue:default"})
+
+	fetched, err := w.Fetcher.Fetch(context.Background())
+	MaybeFail(c, err)
+	c.Assert(fetched.ID, Equals, "123")
+}
+
 func init() {
 	log.SetOutput(ioutil.Discard)
 }